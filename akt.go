@@ -27,8 +27,18 @@ type OpenaiAuthRequest struct {
 	Email       string `json:"email"`                  // Email Openai chatgpt email.
 	Password    string `json:"password"`               // Password Openai chatgpt password.
 	Proxy       string `json:"proxy,omitempty"`        // Proxy global proxy default: http://username:password@ip:port
-	MFA         string `json:"mfa,omitempty"`          // MFA don't need input.
+	MFA         string `json:"mfa,omitempty"`          // MFA base32 TOTP secret of an account with two-factor enabled.
 	AccessToken string `json:"access_token,omitempty"` //  AccessToken used to get puid
+	// ForceRefresh log in again even though a token is cached.
+	ForceRefresh bool `json:"force_refresh,omitempty"`
+	// StaleGrace seconds an expired token is still served while it is refreshed, 0 never serves
+	// it, default to the configured grace.
+	StaleGrace *int `json:"stale_grace,omitempty"`
+	// ClientProfile tls-client profile of the upstream requests, such as chrome_110, default to
+	// the one of the proxy or the configured one.
+	ClientProfile string `json:"client_profile,omitempty"`
+	// UserAgent user agent of the upstream requests, default to the one of the proxy or the configured one.
+	UserAgent string `json:"user_agent,omitempty"`
 }
 
 type OpenaiAuthService interface {
@@ -40,6 +50,18 @@ type OpenaiAuthService interface {
 	PUID(ctx context.Context, req *OpenaiAuthRequest) (*auth.AuthResult, error)
 }
 
+type Authenticator interface {
+	// Login log the account in upstream, abort once ctx is done.
+	Login(ctx context.Context) (*auth.AuthResult, error)
+	// PUID get the puid of the access token of the request.
+	PUID(ctx context.Context) (string, error)
+}
+
+type AuthenticatorFactory interface {
+	// New create the authenticator of a single upstream login of req.
+	New(req *OpenaiAuthRequest) Authenticator
+}
+
 type ProxyService interface {
 	// List get proxy list.
 	List(ctx context.Context) ([]string, error)
@@ -51,11 +73,198 @@ type ProxyService interface {
 
 type AuthExpireResult struct {
 	*auth.AuthResult
-	Expires time.Time `json:"expires"`
+	Expires      time.Time `json:"expires"`
+	PasswordHash string    `json:"password_hash,omitempty"` // PasswordHash bcrypt hash of the password the token was issued for.
 }
 
 type AccessTokenStore interface {
 	Add(ctx context.Context, email string, ak *AuthExpireResult) error
 	Delete(ctx context.Context, email string) error
 	Get(ctx context.Context, email string) (*AuthExpireResult, error)
+	// List get the emails with a cached access token.
+	List(ctx context.Context) ([]string, error)
+}
+
+type CredentialStore interface {
+	// Get the password email last logged in with.
+	Get(ctx context.Context, email string) (string, error)
+	// Set remember the password of email.
+	Set(ctx context.Context, email, password string) error
+	// Delete forget the password of email.
+	Delete(ctx context.Context, email string) error
+	// List get the emails with a password.
+	List(ctx context.Context) ([]string, error)
+}
+
+type Locker interface {
+	// Lock acquire the lock key for ttl, return the token of this acquisition, empty if someone else holds it.
+	Lock(ctx context.Context, key string, ttl time.Duration) (string, error)
+	// Unlock release the lock key if it is still held with token.
+	Unlock(ctx context.Context, key, token string) error
+	// Extend hold the lock key for ttl more if it is still held with token, report whether it is.
+	Extend(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+}
+
+type ProxyBindingService interface {
+	// Get get the proxy bound to email.
+	Get(ctx context.Context, email string) (string, error)
+	// Bind bind email to proxy, email only logs in through this proxy.
+	Bind(ctx context.Context, email, proxy string) error
+	// Unbind remove the proxy bound to email.
+	Unbind(ctx context.Context, email string) error
+}
+
+type ProxyQuarantine interface {
+	// Quarantine keep proxy out of the pool for ttl.
+	Quarantine(ctx context.Context, proxy string, ttl time.Duration) error
+	// Quarantined report whether proxy is out of the pool.
+	Quarantined(ctx context.Context, proxy string) (bool, error)
+}
+
+type ProxyCooldown interface {
+	// Acquire take proxy for a login lasting at most ttl, report false if it is in use or cooling down.
+	Acquire(ctx context.Context, proxy string, ttl time.Duration) (bool, error)
+	// Release let proxy rest for d before it can be acquired again.
+	Release(ctx context.Context, proxy string, d time.Duration) error
+}
+
+type Scheduler interface {
+	// Pick choose the proxy of the next login among candidates.
+	Pick(ctx context.Context, candidates []string) (string, error)
+	// Report record the outcome of a login made through proxy.
+	Report(ctx context.Context, proxy string, err error)
+}
+
+type ProfileStats struct {
+	Attempts  int64 `json:"attempts"`  // Attempts logins made with the client profile.
+	Successes int64 `json:"successes"` // Successes logins which issued a token.
+}
+
+type ProxyStats struct {
+	ID           string           `json:"id"`             // ID proxy identifier, see ProxyID.
+	Proxy        string           `json:"proxy"`          // Proxy redacted proxy address.
+	Attempts     int64            `json:"attempts"`       // Attempts logins made through the proxy.
+	Successes    int64            `json:"successes"`      // Successes logins which issued a token.
+	Failures     map[string]int64 `json:"failures"`       // Failures failed logins by errors code.
+	FailureRate  float64          `json:"failure_rate"`   // FailureRate failed logins over attempts.
+	LastError    string           `json:"last_error"`     // LastError error of the last failed login.
+	LastUsed     time.Time        `json:"last_used"`      // LastUsed time of the last login.
+	AvgLatencyMs int64            `json:"avg_latency_ms"` // AvgLatencyMs average login duration in milliseconds.
+	// Profiles logins by tls-client profile.
+	Profiles map[string]ProfileStats `json:"profiles,omitempty"`
+}
+
+type ProxyStatsService interface {
+	// Record record a login through proxy with the client profile which took latency, err is nil on success.
+	Record(ctx context.Context, proxy, profile string, latency time.Duration, err error) error
+	// Get get the stats of the proxy with id.
+	Get(ctx context.Context, id string) (*ProxyStats, error)
+	// List get the stats of every proxy used.
+	List(ctx context.Context) ([]*ProxyStats, error)
+}
+
+type Account struct {
+	ID             string    `json:"id"`                        // ID opaque account identifier.
+	Email          string    `json:"email"`                     // Email Openai chatgpt email.
+	Password       string    `json:"password,omitempty"`        // Password Openai chatgpt password.
+	MFASecret      string    `json:"mfa_secret,omitempty"`      // MFASecret base32 TOTP secret of an account with two-factor enabled.
+	Labels         []string  `json:"labels,omitempty"`          // Labels free-form tags of the account.
+	PreferredProxy string    `json:"preferred_proxy,omitempty"` // PreferredProxy proxy the account logs in through instead of the pool.
+	Created        time.Time `json:"created"`
+	Updated        time.Time `json:"updated"`
+}
+
+// AuthRequest returns the request logging the account in.
+func (a *Account) AuthRequest() *OpenaiAuthRequest {
+	return &OpenaiAuthRequest{
+		Email:    a.Email,
+		Password: a.Password,
+		Proxy:    a.PreferredProxy,
+		MFA:      a.MFASecret,
+	}
+}
+
+type AccountService interface {
+	// List get every account.
+	List(ctx context.Context) ([]*Account, error)
+	// Get get the account with id.
+	Get(ctx context.Context, id string) (*Account, error)
+	// Create insert account and assign its id.
+	Create(ctx context.Context, account *Account) error
+	// Update replace the account with the same id.
+	Update(ctx context.Context, account *Account) error
+	// Delete remove the account with id.
+	Delete(ctx context.Context, id string) error
+}
+
+// Status of a login job.
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+type Job struct {
+	ID         string             `json:"id"`
+	Status     string             `json:"status"`
+	Email      string             `json:"email,omitempty"`
+	Request    *OpenaiAuthRequest `json:"request,omitempty"`    // Request login to run, cleared once done.
+	AccountID  string             `json:"account_id,omitempty"` // AccountID account to log in instead of Request.
+	Result     *auth.AuthResult   `json:"result,omitempty"`
+	Code       string             `json:"code,omitempty"` // Code error code of a failed job.
+	Error      string             `json:"error,omitempty"`
+	ProxyTried []string           `json:"proxy_tried,omitempty"`
+	Created    time.Time          `json:"created"`
+	Updated    time.Time          `json:"updated"`
+}
+
+type JobStore interface {
+	// Push save job and queue it for any replica to run.
+	Push(ctx context.Context, job *Job) error
+	// Pop take the next queued job, waiting at most timeout, nil if none is queued.
+	Pop(ctx context.Context, timeout time.Duration) (*Job, error)
+	// Save save the state of job.
+	Save(ctx context.Context, job *Job) error
+	// Update save the state of job only if its saved status is still from, report whether it was.
+	Update(ctx context.Context, job *Job, from string) (bool, error)
+	// Requeue update job from the status from and queue it again, report whether it was still from.
+	Requeue(ctx context.Context, job *Job, from string) (bool, error)
+	// Get get the job with id.
+	Get(ctx context.Context, id string) (*Job, error)
+	// List get the ids of the jobs.
+	List(ctx context.Context) ([]string, error)
+}
+
+type JobService interface {
+	// Create queue a login job for job.Request or job.AccountID.
+	Create(ctx context.Context, job *Job) error
+	// Get get the job with id.
+	Get(ctx context.Context, id string) (*Job, error)
+	// Cancel cancel the job with id, pending or running.
+	Cancel(ctx context.Context, id string) error
+}
+
+// Type of a token lifecycle event.
+const (
+	EventTokenIssued    = "token.issued"
+	EventTokenRefreshed = "token.refreshed"
+	EventTokenFailed    = "token.failed"
+	EventAccountBanned  = "account.banned"
+)
+
+type Event struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Email   string    `json:"email"`
+	ProxyID string    `json:"proxy_id,omitempty"` // ProxyID proxy the login went through, see ProxyID.
+	Code    string    `json:"code,omitempty"`     // Code error code of a failed login.
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+type Notifier interface {
+	// Notify deliver event in the background.
+	Notify(ctx context.Context, event *Event)
 }
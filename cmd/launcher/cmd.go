@@ -18,9 +18,12 @@ package launcher
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"time"
 
+	"github.com/chatgpt-accesstoken/core"
 	"github.com/chatgpt-accesstoken/store/redisdb"
 
 	"github.com/chatgpt-accesstoken/signals"
@@ -30,6 +33,10 @@ import (
 )
 
 func NewAccessTokensCommand(ctx context.Context) *cobra.Command {
+	var (
+		fakeUpstream       bool
+		fakeUpstreamScript string
+	)
 	rootCmd := &cobra.Command{
 		Use:   "akt",
 		Args:  cobra.NoArgs,
@@ -39,12 +46,16 @@ func NewAccessTokensCommand(ctx context.Context) *cobra.Command {
 			if err != nil {
 				return err
 			}
+			cfg.FakeUpstream = fakeUpstream || fakeUpstreamScript != ""
+			cfg.FakeUpstreamScript = fakeUpstreamScript
 			if err := cfg.Validate(); err != nil {
 				return err
 			}
 			return cmdRunE(ctx, cfg)
 		},
 	}
+	rootCmd.Flags().BoolVar(&fakeUpstream, "fake-upstream", false, "log in without OpenAI, every login succeeds with a fake token.")
+	rootCmd.Flags().StringVar(&fakeUpstreamScript, "fake-upstream-script", "", "json list of the rules scripting the fake logins, implies --fake-upstream.")
 	return rootCmd
 }
 
@@ -58,9 +69,9 @@ func cmdRunE(ctx context.Context, o Config) error {
 	}
 	<-l.Done()
 
-	// Tear down the launcher, allowing it a few seconds to finish any
-	// in-progress requests.
-	shutdownCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	// Tear down the launcher, allowing it the drain period to finish any
+	// in-progress requests and logins.
+	shutdownCtx, cancel := context.WithTimeout(ctx, o.ShutdownDrain)
 	defer cancel()
 	return l.Shutdown(shutdownCtx)
 }
@@ -74,6 +85,87 @@ type Config struct {
 	UseLocalDB bool `envconfig:"USE_LOCAL_DB" default:"true"`
 	// ProxyFileName set the environment proxy filename.
 	ProxyFileName string `envconfig:"PROXY_FILENAME"`
+	// TokenExpireMargin refresh access token ahead of the expiry in its exp claim.
+	TokenExpireMargin time.Duration `envconfig:"TOKEN_EXPIRE_MARGIN" default:"1h"`
+	// TokenFallbackTTL cache access token without a parsable exp claim for this long.
+	TokenFallbackTTL time.Duration `envconfig:"TOKEN_FALLBACK_TTL" default:"336h"`
+	// LoginLockTTL hold the redis login lock of an email for at most this long, raised to the
+	// longest login with its retries, see LoginLockTimeout.
+	LoginLockTTL time.Duration `envconfig:"LOGIN_LOCK_TTL" default:"2m"`
+	// ProxyQuarantineTTL keep a proxy out of the pool for this long after a login failed because of it.
+	ProxyQuarantineTTL time.Duration `envconfig:"PROXY_QUARANTINE_TTL" default:"10m"`
+	// ProxyCooldownMin let a proxy rest at least this long after each login.
+	ProxyCooldownMin time.Duration `envconfig:"PROXY_COOLDOWN_MIN" default:"5s"`
+	// ProxyCooldownMax let a proxy rest at most this long after each login.
+	ProxyCooldownMax time.Duration `envconfig:"PROXY_COOLDOWN_MAX" default:"10s"`
+	// ProxyStrategy set the proxy scheduling strategy: random, round_robin, lru, weighted or least_failures.
+	ProxyStrategy string `envconfig:"PROXY_STRATEGY" default:"random"`
+	// ProxyFailureWindow count the failures of a proxy within this window for the least_failures strategy.
+	ProxyFailureWindow time.Duration `envconfig:"PROXY_FAILURE_WINDOW" default:"10m"`
+	// ProxyRetryAttempts try at most this many proxies when a login fails because of its proxy.
+	ProxyRetryAttempts int `envconfig:"PROXY_RETRY_ATTEMPTS" default:"3"`
+	// ProxyRetryBackoff wait this long before the first retry, doubled after each retry.
+	ProxyRetryBackoff time.Duration `envconfig:"PROXY_RETRY_BACKOFF" default:"1s"`
+	// LoginTimeout give up an upstream login running longer than this.
+	LoginTimeout time.Duration `envconfig:"LOGIN_TIMEOUT" default:"60s"`
+	// ShutdownDrain wait this long for in-progress requests and logins on shutdown.
+	ShutdownDrain time.Duration `envconfig:"SHUTDOWN_DRAIN" default:"30s"`
+	// TokenStaleGrace serve an expired token this long while it is refreshed in the background,
+	// 0 disables it unless a request asks for it.
+	TokenStaleGrace time.Duration `envconfig:"TOKEN_STALE_GRACE" default:"0s"`
+	// TokenStaleGraceMax cap the grace a request asks for, redis keeps the tokens this long
+	// after they expire.
+	TokenStaleGraceMax time.Duration `envconfig:"TOKEN_STALE_GRACE_MAX" default:"1h"`
+	// TokenRefreshEnabled refresh the cached tokens in the background before they expire,
+	// the passwords are remembered to log the accounts in again.
+	TokenRefreshEnabled bool `envconfig:"TOKEN_REFRESH_ENABLED" default:"false"`
+	// TokenRefreshWindow refresh the tokens expiring within this window.
+	TokenRefreshWindow time.Duration `envconfig:"TOKEN_REFRESH_WINDOW" default:"30m"`
+	// TokenRefreshInterval scan the cached tokens this often.
+	TokenRefreshInterval time.Duration `envconfig:"TOKEN_REFRESH_INTERVAL" default:"1m"`
+	// TokenRefreshConcurrency refresh at most this many tokens at a time.
+	TokenRefreshConcurrency int `envconfig:"TOKEN_REFRESH_CONCURRENCY" default:"4"`
+	// BatchWorkers log at most this many accounts of a batch in at a time.
+	BatchWorkers int `envconfig:"BATCH_WORKERS" default:"4"`
+	// BatchMaxItems reject the batches of more accounts.
+	BatchMaxItems int `envconfig:"BATCH_MAX_ITEMS" default:"1000"`
+	// JobWorkers run at most this many login jobs at a time on each replica.
+	JobWorkers int `envconfig:"JOB_WORKERS" default:"4"`
+	// JobQueueSize queue at most this many login jobs in local mode.
+	JobQueueSize int `envconfig:"JOB_QUEUE_SIZE" default:"1000"`
+	// JobTTL forget the login jobs this long after their last update.
+	JobTTL time.Duration `envconfig:"JOB_TTL" default:"24h"`
+	// JobStaleTimeout report a job failed once it has been running this long, its replica is gone.
+	JobStaleTimeout time.Duration `envconfig:"JOB_STALE_TIMEOUT" default:"10m"`
+	// MasterKeys encrypt the stored tokens and credentials, comma separated id:base64-key
+	// list of AES keys, the first one encrypts and the others only decrypt.
+	MasterKeys string `envconfig:"MASTER_KEYS"`
+	// MasterKeyFile read the master keys from this file, one id:base64-key per line.
+	MasterKeyFile string `envconfig:"MASTER_KEY_FILE"`
+	// WebhookURLs post the token lifecycle events to these comma separated urls.
+	WebhookURLs []string `envconfig:"WEBHOOK_URLS"`
+	// WebhookSecret sign the webhook payloads with this HMAC-SHA256 secret.
+	WebhookSecret string `envconfig:"WEBHOOK_SECRET"`
+	// WebhookAttempts try each webhook delivery at most this many times.
+	WebhookAttempts int `envconfig:"WEBHOOK_ATTEMPTS" default:"5"`
+	// WebhookBackoff wait this long before the first retry, doubled after each one.
+	WebhookBackoff time.Duration `envconfig:"WEBHOOK_BACKOFF" default:"1s"`
+	// WebhookDeadLetter append the undelivered events to this file.
+	WebhookDeadLetter string `envconfig:"WEBHOOK_DEAD_LETTER"`
+	// AuthBaseURL send the login requests to auth0.openai.com to this base url instead.
+	AuthBaseURL string `envconfig:"AUTH_BASE_URL"`
+	// ChatGPTBaseURL send the requests to chat.openai.com to this base url instead.
+	ChatGPTBaseURL string `envconfig:"CHATGPT_BASE_URL"`
+	// ClientProfile log in with this tls-client profile, such as chrome_110, default to firefox_102.
+	ClientProfile string `envconfig:"CLIENT_PROFILE"`
+	// UserAgent log in with this user agent instead of the one of the login library.
+	UserAgent string `envconfig:"USER_AGENT"`
+	// ProxyProfileFile log in through each proxy of this json file with its own profile.
+	ProxyProfileFile string `envconfig:"PROXY_PROFILE_FILE"`
+	// FakeUpstream log in without OpenAI, set by the --fake-upstream flag.
+	FakeUpstream bool `ignored:"true"`
+	// FakeUpstreamScript script the fake logins with the rules of this file.
+	FakeUpstreamScript string `ignored:"true"`
 	// RedisDB set the environment variables of redis
 	RedisDB redisdb.Config
 }
@@ -85,7 +177,57 @@ func Environ() (Config, error) {
 	return cfg, err
 }
 
+// LoginLockTimeout returns LOGIN_LOCK_TTL, raised to the time a login takes
+// at most through PROXY_RETRY_ATTEMPTS proxies with the backoff between them,
+// so that the lock does not expire while its holder is still logging in.
+func (c Config) LoginLockTimeout() time.Duration {
+	ttl := time.Duration(c.ProxyRetryAttempts) * c.LoginTimeout
+	for attempt := 1; attempt < c.ProxyRetryAttempts; attempt++ {
+		ttl += c.ProxyRetryBackoff << (attempt - 1)
+	}
+	if ttl < c.LoginLockTTL {
+		return c.LoginLockTTL
+	}
+	return ttl
+}
+
 func (c Config) Validate() error {
+	if c.ProxyCooldownMin > c.ProxyCooldownMax {
+		return errors.New("config: PROXY_COOLDOWN_MIN is greater than PROXY_COOLDOWN_MAX")
+	}
+
+	if c.TokenStaleGrace > c.TokenStaleGraceMax {
+		return errors.New("config: TOKEN_STALE_GRACE is greater than TOKEN_STALE_GRACE_MAX")
+	}
+
+	if c.TokenRefreshEnabled && c.TokenRefreshConcurrency < 1 {
+		return errors.New("config: TOKEN_REFRESH_CONCURRENCY must be at least 1")
+	}
+
+	if c.MasterKeys != "" && c.MasterKeyFile != "" {
+		return errors.New("config: MASTER_KEYS and MASTER_KEY_FILE are exclusive")
+	}
+
+	if c.BatchWorkers < 1 {
+		return errors.New("config: BATCH_WORKERS must be at least 1")
+	}
+
+	if c.JobWorkers < 1 {
+		return errors.New("config: JOB_WORKERS must be at least 1")
+	}
+
+	if c.JobStaleTimeout < c.LoginLockTimeout() {
+		return fmt.Errorf("config: JOB_STALE_TIMEOUT is shorter than a login with its retries, %s", c.LoginLockTimeout())
+	}
+
+	if len(c.WebhookURLs) > 0 && c.WebhookAttempts < 1 {
+		return errors.New("config: WEBHOOK_ATTEMPTS must be at least 1")
+	}
+
+	if c.ProxyRetryAttempts < 1 {
+		return errors.New("config: PROXY_RETRY_ATTEMPTS must be at least 1")
+	}
+
 	if c.UseLocalDB {
 		if c.ProxyFileName != "" {
 			_, err := os.Stat(c.ProxyFileName)
@@ -97,3 +239,20 @@ func (c Config) Validate() error {
 	}
 	return c.RedisDB.Validate()
 }
+
+// Keyring returns the keyring of the master keys, nil when the encryption is disabled.
+func (c Config) Keyring() (*core.Keyring, error) {
+	spec := c.MasterKeys
+	if c.MasterKeyFile != "" {
+		data, err := os.ReadFile(c.MasterKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		spec = string(data)
+	}
+
+	if spec == "" {
+		return nil, nil
+	}
+	return core.NewKeyring(spec)
+}
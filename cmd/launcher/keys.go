@@ -0,0 +1,74 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package launcher
+
+import (
+	"context"
+	"errors"
+
+	"github.com/spf13/cobra"
+
+	"github.com/chatgpt-accesstoken/core"
+	"github.com/chatgpt-accesstoken/store/redisdb"
+)
+
+func NewKeysCommand(ctx context.Context) *cobra.Command {
+	keysCmd := &cobra.Command{
+		Use:   "keys",
+		Args:  cobra.NoArgs,
+		Short: "manage the master keys encrypting the stored tokens and credentials.",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.PrintErrf("See '%s -h' for help\n", cmd.CommandPath())
+		},
+	}
+
+	keysCmd.AddCommand(&cobra.Command{
+		Use:   "rotate",
+		Args:  cobra.NoArgs,
+		Short: "re-encrypt the stored entries with the first key of MASTER_KEYS.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := Environ()
+			if err != nil {
+				return err
+			}
+			if err := cfg.Validate(); err != nil {
+				return err
+			}
+			if cfg.UseLocalDB {
+				return errors.New("keys: nothing to rotate, the local db is not persisted")
+			}
+
+			keyring, err := cfg.Keyring()
+			if err != nil {
+				return err
+			}
+			if keyring == nil {
+				return errors.New("keys: set MASTER_KEYS or MASTER_KEY_FILE")
+			}
+
+			db := redisdb.New(cfg.RedisDB)
+			defer db.Close()
+
+			n, err := core.RotateKeys(ctx, keyring,
+				core.NewAccessTokenRedisStore(db, cfg.TokenStaleGraceMax), core.NewCredentialRedisStore(db), core.NewAccountService(db),
+				core.NewJobRedisStore(db, cfg.JobTTL))
+			cmd.Printf("re-encrypted %d entries\n", n)
+			return err
+		},
+	})
+	return keysCmd
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package launcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/chatgpt-accesstoken/mock"
+	"github.com/chatgpt-accesstoken/signals"
+)
+
+func NewMockCommand(ctx context.Context) *cobra.Command {
+	var (
+		addr     string
+		accounts string
+	)
+	mockCmd := &cobra.Command{
+		Use:   "mock",
+		Args:  cobra.NoArgs,
+		Short: "serve a local stand-in of the OpenAI login, see AUTH_BASE_URL and CHATGPT_BASE_URL.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var list []mock.Account
+			if accounts != "" {
+				data, err := os.ReadFile(accounts)
+				if err != nil {
+					return err
+				}
+				if err := json.Unmarshal(data, &list); err != nil {
+					return fmt.Errorf("mock: cannot parse %s: %s", accounts, err)
+				}
+			}
+
+			srv := &http.Server{Addr: addr, Handler: mock.NewHandler(list...)}
+			ctx := signals.WithStandardSignals(ctx)
+			go func() {
+				<-ctx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				srv.Shutdown(shutdownCtx)
+			}()
+
+			cmd.Printf("mock: serving %d accounts on %s\n", len(list), addr)
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		},
+	}
+	mockCmd.Flags().StringVar(&addr, "addr", ":8081", "address to listen on.")
+	mockCmd.Flags().StringVar(&accounts, "accounts", "", "json list of the accounts logged in, with email, password, mfa_secret and banned.")
+	return mockCmd
+}
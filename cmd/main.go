@@ -44,6 +44,8 @@ func main() {
 	ctx := context.Background()
 	rootCmd := NewCommand()
 	rootCmd.AddCommand(launcher.NewAccessTokensCommand(ctx))
+	rootCmd.AddCommand(launcher.NewKeysCommand(ctx))
+	rootCmd.AddCommand(launcher.NewMockCommand(ctx))
 	rootCmd.SilenceUsage = true
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -0,0 +1,135 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+)
+
+type accountLocalService struct {
+	db   map[string]*akt.Account
+	lock sync.RWMutex
+}
+
+func NewAccountLocalService() akt.AccountService {
+	return &accountLocalService{
+		db: make(map[string]*akt.Account),
+	}
+}
+
+func (s *accountLocalService) List(ctx context.Context) ([]*akt.Account, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	list := make([]*akt.Account, 0, len(s.db))
+	for _, account := range s.db {
+		v := *account
+		list = append(list, &v)
+	}
+	return list, nil
+}
+
+func (s *accountLocalService) Get(ctx context.Context, id string) (*akt.Account, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	account, ok := s.db[id]
+	if !ok {
+		return nil, errors.ErrNotFound
+	}
+	v := *account
+	return &v, nil
+}
+
+func (s *accountLocalService) Create(ctx context.Context, account *akt.Account) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := uniqueEmail(s.list(), account); err != nil {
+		return err
+	}
+
+	account.ID = newID()
+	account.Created = time.Now()
+	account.Updated = account.Created
+	v := *account
+	s.db[account.ID] = &v
+	return nil
+}
+
+func (s *accountLocalService) Update(ctx context.Context, account *akt.Account) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old, ok := s.db[account.ID]
+	if !ok {
+		return errors.ErrNotFound
+	}
+	if err := uniqueEmail(s.list(), account); err != nil {
+		return err
+	}
+
+	account.Created = old.Created
+	account.Updated = time.Now()
+	v := *account
+	s.db[account.ID] = &v
+	return nil
+}
+
+func (s *accountLocalService) Delete(ctx context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.db[id]; !ok {
+		return errors.ErrNotFound
+	}
+	delete(s.db, id)
+	return nil
+}
+
+func (s *accountLocalService) list() []*akt.Account {
+	list := make([]*akt.Account, 0, len(s.db))
+	for _, account := range s.db {
+		list = append(list, account)
+	}
+	return list
+}
+
+// newID returns a random opaque id.
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// uniqueEmail returns an error if another account of list has the email of account.
+func uniqueEmail(list []*akt.Account, account *akt.Account) error {
+	for _, v := range list {
+		if v.Email == account.Email && v.ID != account.ID {
+			return errors.NewCode(errors.CodeInvalidRequest, fmt.Sprintf("account: %s already exists", account.Email))
+		}
+	}
+	return nil
+}
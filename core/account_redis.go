@@ -0,0 +1,120 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+	"github.com/chatgpt-accesstoken/store/redisdb"
+)
+
+// accountKey is the redis hash of the accounts by id.
+const accountKey = "akt:account"
+
+type accountService struct {
+	db *redisdb.Redis
+}
+
+func NewAccountService(db *redisdb.Redis) akt.AccountService {
+	return &accountService{db: db}
+}
+
+func (s *accountService) List(ctx context.Context) ([]*akt.Account, error) {
+	all, err := s.db.HGetAll(accountKey)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*akt.Account, 0, len(all))
+	for _, v := range all {
+		account := new(akt.Account)
+		if err := json.Unmarshal([]byte(v), account); err != nil {
+			return nil, err
+		}
+		list = append(list, account)
+	}
+	return list, nil
+}
+
+func (s *accountService) Get(ctx context.Context, id string) (*akt.Account, error) {
+	v, err := s.db.HGet(accountKey, id)
+	if err != nil {
+		return nil, err
+	}
+	if v == "" {
+		return nil, errors.ErrNotFound
+	}
+
+	account := new(akt.Account)
+	if err := json.Unmarshal([]byte(v), account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (s *accountService) Create(ctx context.Context, account *akt.Account) error {
+	list, err := s.List(ctx)
+	if err != nil {
+		return err
+	}
+	if err := uniqueEmail(list, account); err != nil {
+		return err
+	}
+
+	account.ID = newID()
+	account.Created = time.Now()
+	account.Updated = account.Created
+	return s.save(account)
+}
+
+func (s *accountService) Update(ctx context.Context, account *akt.Account) error {
+	old, err := s.Get(ctx, account.ID)
+	if err != nil {
+		return err
+	}
+
+	list, err := s.List(ctx)
+	if err != nil {
+		return err
+	}
+	if err := uniqueEmail(list, account); err != nil {
+		return err
+	}
+
+	account.Created = old.Created
+	account.Updated = time.Now()
+	return s.save(account)
+}
+
+func (s *accountService) Delete(ctx context.Context, id string) error {
+	if _, err := s.Get(ctx, id); err != nil {
+		return err
+	}
+	return s.db.HDel(accountKey, id)
+}
+
+func (s *accountService) save(account *akt.Account) error {
+	data, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	return s.db.HSet(accountKey, account.ID, string(data))
+}
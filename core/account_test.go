@@ -0,0 +1,96 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"testing"
+
+	akt "github.com/chatgpt-accesstoken"
+	errors2 "github.com/chatgpt-accesstoken/errors"
+)
+
+func TestAccountService(t *testing.T) {
+	tests := []struct {
+		name string
+		svc  func(t *testing.T) akt.AccountService
+	}{
+		{
+			name: "local",
+			svc:  func(t *testing.T) akt.AccountService { return NewAccountLocalService() },
+		},
+		{
+			name: "redis",
+			svc: func(t *testing.T) akt.AccountService {
+				db, _ := newTestRedis(t)
+				return NewAccountService(db)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testAccountService(t, tt.svc(t))
+		})
+	}
+}
+
+func testAccountService(t *testing.T, svc akt.AccountService) {
+	ctx := context.Background()
+
+	if _, err := svc.Get(ctx, "unknown"); err != errors2.ErrNotFound {
+		t.Errorf("Want not found getting an unknown account, got %v", err)
+	}
+
+	account := &akt.Account{Email: "a@b.c", Password: "secret", Labels: []string{"team"}}
+	if err := svc.Create(ctx, account); err != nil {
+		t.Fatal(err)
+	}
+	if account.ID == "" || account.Created.IsZero() {
+		t.Errorf("Want id and creation time assigned, got %+v", account)
+	}
+
+	if err := svc.Create(ctx, &akt.Account{Email: "a@b.c", Password: "other"}); err == nil {
+		t.Errorf("Want error creating a duplicate email")
+	}
+
+	account.Password = "changed"
+	if err := svc.Update(ctx, account); err != nil {
+		t.Fatal(err)
+	}
+	got, err := svc.Get(ctx, account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != "a@b.c" || got.Password != "changed" || len(got.Labels) != 1 {
+		t.Errorf("Want account updated, got %+v", got)
+	}
+
+	if err := svc.Update(ctx, &akt.Account{ID: "unknown", Email: "d@e.f"}); err != errors2.ErrNotFound {
+		t.Errorf("Want not found updating an unknown account, got %v", err)
+	}
+
+	if list, err := svc.List(ctx); err != nil || len(list) != 1 {
+		t.Errorf("Want 1 account listed, got %v, %v", list, err)
+	}
+
+	if err := svc.Delete(ctx, account.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Delete(ctx, account.ID); err != errors2.ErrNotFound {
+		t.Errorf("Want not found deleting twice, got %v", err)
+	}
+}
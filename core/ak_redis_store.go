@@ -0,0 +1,85 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/store/redisdb"
+)
+
+// accessTokenKey is the redis key prefix of the cached access tokens.
+const accessTokenKey = "akt:token:"
+
+type accessTokenRedisStore struct {
+	db     *redisdb.Redis
+	retain time.Duration
+}
+
+// NewAccessTokenRedisStore returns an AccessTokenStore shared by all replicas,
+// each entry is removed by redis retain after it expires, so that it can
+// still be served stale.
+func NewAccessTokenRedisStore(db *redisdb.Redis, retain time.Duration) akt.AccessTokenStore {
+	return &accessTokenRedisStore{db: db, retain: retain}
+}
+
+func (a *accessTokenRedisStore) Add(ctx context.Context, email string, ak *akt.AuthExpireResult) error {
+	ttl := time.Until(ak.Expires) + a.retain
+	if ttl <= 0 {
+		return fmt.Errorf("redis: %s token has expired", email)
+	}
+
+	data, err := json.Marshal(ak)
+	if err != nil {
+		return err
+	}
+	return a.db.Set(accessTokenKey+email, string(data), ttl)
+}
+
+func (a *accessTokenRedisStore) Delete(ctx context.Context, email string) error {
+	return a.db.Del(accessTokenKey + email)
+}
+
+func (a *accessTokenRedisStore) Get(ctx context.Context, email string) (*akt.AuthExpireResult, error) {
+	v := a.db.Get(accessTokenKey + email)
+	if v == "" {
+		return nil, fmt.Errorf("redis: cannot find sk")
+	}
+
+	ak := new(akt.AuthExpireResult)
+	if err := json.Unmarshal([]byte(v), ak); err != nil {
+		return nil, err
+	}
+	return ak, nil
+}
+
+func (a *accessTokenRedisStore) List(ctx context.Context) ([]string, error) {
+	keys, err := a.db.Scan(accessTokenKey + "*")
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, strings.TrimPrefix(key, accessTokenKey))
+	}
+	return list, nil
+}
@@ -56,6 +56,17 @@ func (a *accessTokenStore) Get(ctx context.Context, email string) (*akt.AuthExpi
 	return v, nil
 }
 
+func (a *accessTokenStore) List(ctx context.Context) ([]string, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	list := make([]string, 0, len(a.db))
+	for email := range a.db {
+		list = append(list, email)
+	}
+	return list, nil
+}
+
 func NewAccessTokenStore() akt.AccessTokenStore {
 	return &accessTokenStore{db: make(map[string]*akt.AuthExpireResult)}
 }
@@ -0,0 +1,69 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+
+	akt "github.com/chatgpt-accesstoken"
+)
+
+func TestAccessTokenRedisStore(t *testing.T) {
+	db, s := newTestRedis(t)
+	ctx := context.Background()
+	store := NewAccessTokenRedisStore(db, 0)
+
+	if _, err := store.Get(ctx, "a@b.c"); err == nil {
+		t.Errorf("Want error getting an unknown email")
+	}
+
+	want := &akt.AuthExpireResult{
+		AuthResult: &auth.AuthResult{AccessToken: "token", PUID: "puid"},
+		Expires:    time.Now().Add(time.Minute).Truncate(time.Second),
+	}
+	if err := store.Add(ctx, "a@b.c", want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Get(ctx, "a@b.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != want.AccessToken || got.PUID != want.PUID || !got.Expires.Equal(want.Expires) {
+		t.Errorf("Want result %+v, got %+v", want, got)
+	}
+
+	if list, err := store.List(ctx); err != nil || len(list) != 1 || list[0] != "a@b.c" {
+		t.Errorf("Want a@b.c listed, got %v, %v", list, err)
+	}
+
+	s.FastForward(time.Minute)
+	if _, err := store.Get(ctx, "a@b.c"); err == nil {
+		t.Errorf("Want token evicted once expired")
+	}
+
+	if err := store.Add(ctx, "a@b.c", &akt.AuthExpireResult{
+		AuthResult: &auth.AuthResult{AccessToken: "token"},
+		Expires:    time.Now().Add(-time.Second),
+	}); err == nil {
+		t.Errorf("Want error adding an expired token")
+	}
+}
@@ -18,47 +18,81 @@ package core
 
 import (
 	"context"
-	"errors"
+	"time"
 
 	"github.com/acheong08/OpenAIAuth/auth"
 	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
 )
 
-type openaiAuthService struct{}
+type openaiAuthService struct {
+	factory  akt.AuthenticatorFactory
+	timeout  time.Duration
+	inflight *Inflight
+}
+
+// ServiceOption configures the upstream openai auth service.
+type ServiceOption func(*openaiAuthService)
+
+// WithAuthenticator logs in through the authenticators of factory instead
+// of OpenAI.
+func WithAuthenticator(factory akt.AuthenticatorFactory) ServiceOption {
+	return func(s *openaiAuthService) {
+		s.factory = factory
+	}
+}
+
+// WithLoginTimeout gives up a login running longer than timeout.
+func WithLoginTimeout(timeout time.Duration) ServiceOption {
+	return func(s *openaiAuthService) {
+		s.timeout = timeout
+	}
+}
 
-func New() akt.OpenaiAuthService {
-	return &openaiAuthService{}
+// WithInflight tracks the running logins into inflight.
+func WithInflight(inflight *Inflight) ServiceOption {
+	return func(s *openaiAuthService) {
+		s.inflight = inflight
+	}
+}
+
+func New(opts ...ServiceOption) akt.OpenaiAuthService {
+	s := &openaiAuthService{
+		factory:  new(openaiAuthenticatorFactory),
+		inflight: NewInflight(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s *openaiAuthService) All(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
-	authenticator := auth.NewAuthenticator(req.Email, req.Password, req.Proxy)
-	if err := authenticator.Begin(); err != nil {
-		return nil, OError{Err: err}
+	resp, err := s.login(ctx, req)
+	if err != nil {
+		return nil, err
 	}
 
-	resp := authenticator.GetAuthResult()
 	if resp.AccessToken == "" || resp.PUID == "" {
-		return nil, errors.New("access_token or puid is empty")
+		return nil, errors.NewCode(errors.CodeUpstream, "access_token or puid is empty")
 	}
-	return &resp, nil
+	return resp, nil
 }
 
 func (s *openaiAuthService) AccessToken(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
-	authenticator := auth.NewAuthenticator(req.Email, req.Password, req.Proxy)
-	if err := authenticator.Begin(); err != nil {
-		return nil, OError{Err: err}
-	}
-
-	return &authenticator.AuthResult, nil
+	return s.login(ctx, req)
 }
 
 func (s *openaiAuthService) PUID(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
-	authenticator := auth.NewAuthenticator(req.Email, req.Password, req.Proxy)
-	authenticator.AuthResult.AccessToken = req.AccessToken
+	authenticator := s.factory.New(req)
 
-	puid, err := authenticator.GetPUID()
+	var puid string
+	err := s.run(ctx, func(ctx context.Context) (err error) {
+		puid, err = authenticator.PUID(ctx)
+		return err
+	})
 	if err != nil {
-		return nil, OError{Err: err}
+		return nil, err
 	}
 
 	return &auth.AuthResult{
@@ -66,3 +100,48 @@ func (s *openaiAuthService) PUID(ctx context.Context, req *akt.OpenaiAuthRequest
 		PUID:        puid,
 	}, nil
 }
+
+func (s *openaiAuthService) login(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	authenticator := s.factory.New(req)
+
+	var resp *auth.AuthResult
+	err := s.run(ctx, func(ctx context.Context) (err error) {
+		resp, err = authenticator.Login(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// run calls login with a ctx ending with the login timeout, it returns
+// errors.ErrLoginTimeout as soon as ctx is done or the login timeout
+// expires.
+func (s *openaiAuthService) run(ctx context.Context, login func(ctx context.Context) error) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	if err := s.inflight.add(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer s.inflight.done()
+		done <- login(ctx)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return errors.ErrLoginTimeout
+	case err := <-done:
+		if err != nil && ctx.Err() != nil {
+			// the login failed because its requests were cancelled.
+			return errors.ErrLoginTimeout
+		}
+		return err
+	}
+}
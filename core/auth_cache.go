@@ -18,13 +18,17 @@ package core
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
 	"time"
 
 	"github.com/workpieces/log"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/acheong08/OpenAIAuth/auth"
 	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
 )
 
 type openaiAuthCache struct {
@@ -32,123 +36,639 @@ type openaiAuthCache struct {
 	svc      akt.OpenaiAuthService
 	akStore  akt.AccessTokenStore
 	logger   log.Logger
+
+	expireMargin time.Duration
+	fallbackTTL  time.Duration
+
+	flight  *singleflight.Group
+	locker  akt.Locker
+	lockTTL time.Duration
+	poll    time.Duration
+
+	bindingSvc    akt.ProxyBindingService
+	quarantine    akt.ProxyQuarantine
+	quarantineTTL time.Duration
+
+	cooldown    akt.ProxyCooldown
+	cooldownMin time.Duration
+	cooldownMax time.Duration
+
+	scheduler akt.Scheduler
+	statsSvc  akt.ProxyStatsService
+
+	retryAttempts int
+	retryBackoff  time.Duration
+
+	credStore akt.CredentialStore
+
+	staleGrace    time.Duration
+	staleGraceMax time.Duration
+	notifier      akt.Notifier
+}
+
+// loginLockKey is the lock held by the replica logging an email in.
+const loginLockKey = "login:"
+
+// CacheOption configures the access token cache.
+type CacheOption func(*openaiAuthCache)
+
+// WithExpireMargin refreshes a token margin ahead of the expiry
+// found in its exp claim.
+func WithExpireMargin(margin time.Duration) CacheOption {
+	return func(o *openaiAuthCache) {
+		o.expireMargin = margin
+	}
+}
+
+// WithFallbackTTL sets how long a token is cached when it is not a jwt
+// carrying an exp claim.
+func WithFallbackTTL(ttl time.Duration) CacheOption {
+	return func(o *openaiAuthCache) {
+		o.fallbackTTL = ttl
+	}
+}
+
+// WithLocker coalesces logins of the same email across replicas,
+// the lock is held for at most ttl by the replica logging in.
+func WithLocker(locker akt.Locker, ttl time.Duration) CacheOption {
+	return func(o *openaiAuthCache) {
+		o.locker = locker
+		o.lockTTL = ttl
+	}
+}
+
+// WithProxyBinding binds each email to the proxy of its first login.
+func WithProxyBinding(bindingSvc akt.ProxyBindingService) CacheOption {
+	return func(o *openaiAuthCache) {
+		o.bindingSvc = bindingSvc
+	}
+}
+
+// WithQuarantine keeps a proxy out of the pool for ttl after a login
+// failed because of the proxy.
+func WithQuarantine(quarantine akt.ProxyQuarantine, ttl time.Duration) CacheOption {
+	return func(o *openaiAuthCache) {
+		o.quarantine = quarantine
+		o.quarantineTTL = ttl
+	}
+}
+
+// WithCooldown lets a proxy rest for a random period between min and max
+// after each login before it can be used again.
+func WithCooldown(cooldown akt.ProxyCooldown, min, max time.Duration) CacheOption {
+	return func(o *openaiAuthCache) {
+		o.cooldown = cooldown
+		o.cooldownMin = min
+		o.cooldownMax = max
+	}
+}
+
+// WithScheduler chooses the proxy of an email without a bound proxy.
+func WithScheduler(scheduler akt.Scheduler) CacheOption {
+	return func(o *openaiAuthCache) {
+		o.scheduler = scheduler
+	}
+}
+
+// WithProxyStats records the outcome of every login made through the pool.
+func WithProxyStats(statsSvc akt.ProxyStatsService) CacheOption {
+	return func(o *openaiAuthCache) {
+		o.statsSvc = statsSvc
+	}
+}
+
+// WithRetry logs in again through another proxy, up to attempts logins in
+// total, when a login fails because of its proxy. The backoff between two
+// attempts doubles after each one.
+func WithRetry(attempts int, backoff time.Duration) CacheOption {
+	return func(o *openaiAuthCache) {
+		o.retryAttempts = attempts
+		o.retryBackoff = backoff
+	}
+}
+
+// WithCredentials remembers the password of each email logged in, so that
+// its token can be refreshed in the background.
+func WithCredentials(credStore akt.CredentialStore) CacheOption {
+	return func(o *openaiAuthCache) {
+		o.credStore = credStore
+	}
+}
+
+// WithStaleGrace serves a token up to grace after it expired while a
+// single login refreshes it in the background. A request may ask for
+// another grace, at most max.
+func WithStaleGrace(grace, max time.Duration) CacheOption {
+	return func(o *openaiAuthCache) {
+		o.staleGrace = grace
+		o.staleGraceMax = max
+	}
+}
+
+// WithRevalidateNotifier notifies the background refreshes of the stale
+// tokens, no request waits for them to be notified outside the cache.
+func WithRevalidateNotifier(notifier akt.Notifier) CacheOption {
+	return func(o *openaiAuthCache) {
+		o.notifier = notifier
+	}
+}
+
+// expires returns when the token of resp should no longer be served.
+func (o openaiAuthCache) expires(resp *auth.AuthResult) time.Time {
+	exp, err := tokenExpires(resp.AccessToken)
+	if err != nil {
+		o.logger.Info(fmt.Sprintf("api: cannot parse token expiry, fallback to %s: %s", o.fallbackTTL, err))
+		return time.Now().Add(o.fallbackTTL)
+	}
+
+	// a token issued with less than the margin left is still served until its real expiry.
+	if at := exp.Add(-o.expireMargin); at.After(time.Now()) {
+		return at
+	}
+	return exp
 }
 
 func (o openaiAuthCache) All(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
-	res, err := o.akStore.Get(ctx, req.Email)
-	if err == nil {
-		if time.Now().Before(res.Expires) {
-			o.logger.Info("api: token not expire")
-			return res.AuthResult, nil
-		} else {
-			o.logger.Info("api: token has expire")
-			goto LABEL
+	return o.get(ctx, "all", req, o.svc.All)
+}
+
+func (o openaiAuthCache) AccessToken(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	return o.get(ctx, "access_token", req, o.svc.AccessToken)
+}
+
+// PUID looks the puid of the access token of req up through the pool, it
+// is neither cached nor shared by email since only the token proves whose
+// puid it is.
+func (o openaiAuthCache) PUID(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	return o.retry(ctx, req, o.svc.PUID, akt.LoginTraceFrom(ctx))
+}
+
+type loginFunc func(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error)
+
+// get serves the cached token of req.Email, concurrent misses for the same
+// email share the result of a single upstream login.
+func (o openaiAuthCache) get(ctx context.Context, kind string, req *akt.OpenaiAuthRequest, login loginFunc) (*auth.AuthResult, error) {
+	// a caller forcing a login must know the password of the token it replaces.
+	if req.ForceRefresh && !refreshing(ctx) {
+		if res, err := o.akStore.Get(ctx, req.Email); err == nil && res.PasswordHash != "" {
+			if _, err := verify(res, req.Password); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !forced(ctx, req) {
+		res, ok := o.lookup(ctx, req.Email)
+		if ok && servable(res, req.Password) {
+			return verify(res, req.Password)
+		}
+		if res != nil && o.stale(res, req) {
+			resp, err := verify(res, req.Password)
+			if err != nil {
+				return nil, err
+			}
+			o.revalidate(kind, req, login)
+			akt.LoginTraceFrom(ctx).MarkStale()
+			return resp, nil
+		}
+	}
+
+	// the login is shared, it outlives the caller which started it.
+	ch := o.flight.DoChan(kind+":"+req.Email, func() (interface{}, error) {
+		c, cancel := context.WithTimeout(detached{ctx}, o.lockTTL)
+		defer cancel()
+
+		v := &flightResult{trace: new(akt.LoginTrace)}
+		var err error
+		v.res, err = o.login(c, req, login, v.trace)
+		return v, err
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		v := res.Val.(*flightResult)
+		akt.LoginTraceFrom(ctx).Merge(v.trace)
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		if res.Shared {
+			o.logger.Info("api: share login result")
+		}
+		// followers must know the password of the email logged in by the leader.
+		return verify(v.res, req.Password)
+	}
+}
+
+// stale reports whether the expired token res may be served to req.
+func (o openaiAuthCache) stale(res *akt.AuthExpireResult, req *akt.OpenaiAuthRequest) bool {
+	grace := o.staleGrace
+	if req.StaleGrace != nil {
+		grace = time.Duration(*req.StaleGrace) * time.Second
+		if grace > o.staleGraceMax {
+			grace = o.staleGraceMax
+		}
+	}
+	return grace > 0 && servable(res, req.Password) && time.Now().Before(res.Expires.Add(grace))
+}
+
+// revalidate refreshes the token of req in the background, joining the
+// login of req.Email in flight if any.
+func (o openaiAuthCache) revalidate(kind string, req *akt.OpenaiAuthRequest, login loginFunc) {
+	r := *req
+	ctx := withRefresh(context.Background())
+	o.flight.DoChan(kind+":"+req.Email, func() (interface{}, error) {
+		v := &flightResult{trace: new(akt.LoginTrace)}
+		var err error
+		v.res, err = o.login(ctx, &r, login, v.trace)
+		if err != nil {
+			o.logger.WithField("email", r.Email).Error(fmt.Sprintf("api: cannot refresh stale token: %s", err))
 		}
+		if o.notifier != nil {
+			notifyLogin(ctx, o.notifier, r.Email, v.trace, err)
+		}
+		return v, err
+	})
+}
+
+// detached keeps the values of its ctx but is never done.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// flightResult is the login shared by concurrent callers.
+type flightResult struct {
+	res   *akt.AuthExpireResult
+	trace *akt.LoginTrace
+}
+
+// servable reports whether res may be served from the cache to a caller
+// sending password, a token cached without a password is never served to
+// a caller sending one so that it is logged in again.
+func servable(res *akt.AuthExpireResult, password string) bool {
+	return res.PasswordHash != "" || password == ""
+}
+
+// verify returns the token of res if password matches the one it was issued for.
+func verify(res *akt.AuthExpireResult, password string) (*auth.AuthResult, error) {
+	if res.PasswordHash == "" {
+		if password != "" {
+			return nil, errors.ErrPasswordMismatch
+		}
+		return res.AuthResult, nil
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(res.PasswordHash), []byte(password)); err != nil {
+		return nil, errors.ErrPasswordMismatch
+	}
+	return res.AuthResult, nil
+}
+
+// lookup returns the token of email, ok reports whether it has not expired.
+func (o openaiAuthCache) lookup(ctx context.Context, email string) (*akt.AuthExpireResult, bool) {
+	res, err := o.akStore.Get(ctx, email)
+	if err != nil {
+		return nil, false
+	}
+
+	if time.Now().Before(res.Expires) {
+		o.logger.Info("api: token not expire")
+		return res, true
 	}
 
-LABEL:
-	if req.Proxy == "" {
-		list, err := o.proxySvc.List(ctx)
+	o.logger.Info("api: token has expire")
+	return res, false
+}
+
+func (o openaiAuthCache) login(ctx context.Context, req *akt.OpenaiAuthRequest, login loginFunc, trace *akt.LoginTrace) (*akt.AuthExpireResult, error) {
+	if o.locker != nil {
+		key := loginLockKey + req.Email
+		token, err := o.locker.Lock(ctx, key, o.lockTTL)
 		if err != nil {
 			return nil, err
 		}
+		if token == "" {
+			return o.wait(ctx, req.Email, key)
+		}
+		defer o.locker.Unlock(context.Background(), key, token)
+
+		// another replica may have stored the token between the lookup and the lock.
+		if res, ok := o.lookup(ctx, req.Email); ok && !forced(ctx, req) && servable(res, req.Password) {
+			return res, nil
+		}
+	}
 
-		idx := rand.Intn(len(list))
-		req.Proxy = list[idx]
+	if _, err := o.akStore.Get(ctx, req.Email); err == nil || forced(ctx, req) {
+		trace.MarkRefreshed()
 	}
-	resp, err := o.svc.All(ctx, req)
+
+	resp, err := o.retry(ctx, req, login, trace)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := o.akStore.Add(ctx, req.Email, &akt.AuthExpireResult{
+	res := &akt.AuthExpireResult{
 		AuthResult: resp,
-		Expires:    time.Now().Add(14 * 24 * time.Hour),
-	}); err != nil {
+		Expires:    o.expires(resp),
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		res.PasswordHash = string(hash)
+	}
+
+	if err := o.akStore.Add(ctx, req.Email, res); err != nil {
 		return nil, err
 	}
-	return resp, nil
-}
 
-func (o openaiAuthCache) AccessToken(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
-	res, err := o.akStore.Get(ctx, req.Email)
-	if err == nil {
-		if time.Now().Before(res.Expires) {
-			o.logger.Info("api: token not expire")
-			return res.AuthResult, nil
-		} else {
-			o.logger.Info("api: token has expire")
-			goto LABEL
+	if o.credStore != nil && req.Password != "" {
+		if err := o.credStore.Set(ctx, req.Email, req.Password); err != nil {
+			o.logger.WithField("email", req.Email).Error(fmt.Sprintf("api: cannot remember credentials: %s", err))
 		}
 	}
+	return res, nil
+}
+
+// retry logs req in, a login failing because of its pool proxy is retried
+// through another proxy after a backoff.
+func (o openaiAuthCache) retry(ctx context.Context, req *akt.OpenaiAuthRequest, login loginFunc, trace *akt.LoginTrace) (*auth.AuthResult, error) {
+	if req.Proxy != "" {
+		resp, err := login(ctx, req)
+		trace.Attempt(req.Proxy, err)
+		return resp, err
+	}
 
-LABEL:
+	// the pool proxy of an attempt is not pinned for the next ones of the caller.
+	r := *req
+	req = &r
 
-	if req.Proxy == "" {
-		list, err := o.proxySvc.List(ctx)
+	var tried []string
+	for attempt := 1; ; attempt++ {
+		proxy, err := o.proxy(ctx, req.Email, tried)
 		if err != nil {
 			return nil, err
 		}
 
-		idx := rand.Intn(len(list))
-		req.Proxy = list[idx]
+		req.Proxy = proxy
+		resp, err := o.attempt(ctx, req, login)
+		trace.Attempt(proxy, err)
+		if err == nil || !proxyFailure(err) || attempt >= o.retryAttempts {
+			return resp, err
+		}
+
+		tried = append(tried, proxy)
+		if _, perr := o.available(ctx, tried); perr != nil {
+			// no proxy is left to try, report the login failure.
+			return nil, err
+		}
+
+		backoff := o.retryBackoff << (attempt - 1)
+		o.logger.WithField("attempt", attempt).WithField("backoff", backoff).Info(fmt.Sprintf("api: retry on another proxy: %s", err))
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
 	}
-	resp, err := o.svc.AccessToken(ctx, req)
-	if err != nil {
-		return nil, err
+}
+
+// attempt logs req in through its pool proxy and records the outcome.
+func (o openaiAuthCache) attempt(ctx context.Context, req *akt.OpenaiAuthRequest, login loginFunc) (*auth.AuthResult, error) {
+	defer o.release(req.Proxy)
+
+	c, profile := withProfileReport(ctx)
+	start := time.Now()
+	resp, err := login(c, req)
+	o.scheduler.Report(ctx, req.Proxy, err)
+	o.record(ctx, req.Proxy, profile.Name(), time.Since(start), err)
+	if err != nil && proxyFailure(err) {
+		o.quarantineProxy(ctx, req.Proxy, err)
 	}
+	return resp, err
+}
 
-	if err := o.akStore.Add(ctx, req.Email, &akt.AuthExpireResult{
-		AuthResult: resp,
-		Expires:    time.Now().Add(14 * 24 * time.Hour),
-	}); err != nil {
-		return nil, err
+// proxy acquires the proxy email logs in through, skipping the proxies
+// already tried. An email keeps the proxy bound on its first login until
+// the proxy is deleted or quarantined. When every candidate is cooling
+// down it waits until one is released.
+func (o openaiAuthCache) proxy(ctx context.Context, email string, tried []string) (string, error) {
+	ticker := time.NewTicker(o.poll)
+	defer ticker.Stop()
+
+	for {
+		proxy, err := o.tryProxy(ctx, email, tried)
+		if err != nil || proxy != "" {
+			return proxy, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
 	}
-	return resp, nil
 }
 
-func (o openaiAuthCache) PUID(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
-	res, err := o.akStore.Get(ctx, req.Email)
-	if err == nil {
-		if time.Now().Before(res.Expires) {
-			o.logger.Info("api: token not expire")
-			return res.AuthResult, nil
-		} else {
-			o.logger.Info("api: token has expire")
-			goto LABEL
+// tryProxy returns an empty proxy when every candidate of email is cooling down.
+func (o openaiAuthCache) tryProxy(ctx context.Context, email string, tried []string) (string, error) {
+	list, err := o.available(ctx, tried)
+	if err != nil {
+		return "", err
+	}
+
+	var bound string
+	if o.bindingSvc != nil && email != "" {
+		bound, err = o.bindingSvc.Get(ctx, email)
+		if err != nil && err != errors.ErrNotFound {
+			return "", err
 		}
 	}
 
-LABEL:
+	candidates := list
+	for _, proxy := range list {
+		if proxy == bound {
+			// the email waits for its own proxy rather than moving to another one.
+			candidates = []string{bound}
+			break
+		}
+	}
 
-	if req.Proxy == "" {
-		list, err := o.proxySvc.List(ctx)
+	for len(candidates) > 0 {
+		proxy, err := o.scheduler.Pick(ctx, candidates)
 		if err != nil {
-			return nil, err
+			return "", err
+		}
+
+		ok, err := o.acquire(ctx, proxy)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			candidates = without(candidates, proxy)
+			continue
 		}
 
-		idx := rand.Intn(len(list))
-		req.Proxy = list[idx]
+		if o.bindingSvc != nil && email != "" && proxy != bound {
+			if bound != "" {
+				o.logger.WithField("email", email).Info("api: rebind unavailable proxy")
+			}
+			if err := o.bindingSvc.Bind(ctx, email, proxy); err != nil {
+				o.release(proxy)
+				return "", err
+			}
+		}
+		return proxy, nil
+	}
+	return "", nil
+}
+
+// without returns a copy of list without v.
+func without(list []string, v string) []string {
+	res := make([]string, 0, len(list))
+	for _, s := range list {
+		if s != v {
+			res = append(res, s)
+		}
 	}
-	resp, err := o.svc.PUID(ctx, req)
+	return res
+}
+
+// available returns the proxies of the pool which are neither tried nor quarantined.
+func (o openaiAuthCache) available(ctx context.Context, tried []string) ([]string, error) {
+	list, err := o.proxySvc.List(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := o.akStore.Add(ctx, req.Email, &akt.AuthExpireResult{
-		AuthResult: resp,
-		Expires:    time.Now().Add(14 * 24 * time.Hour),
-	}); err != nil {
-		return nil, err
+	for _, proxy := range tried {
+		list = without(list, proxy)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("api: all proxies have been tried")
+	}
+
+	if o.quarantine == nil {
+		return list, nil
+	}
+
+	available := make([]string, 0, len(list))
+	for _, proxy := range list {
+		ok, err := o.quarantine.Quarantined(ctx, proxy)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			available = append(available, proxy)
+		}
+	}
+	if len(available) == 0 {
+		return nil, fmt.Errorf("api: all %d proxies are quarantined", len(list))
+	}
+	return available, nil
+}
+
+// acquire takes proxy for a login unless it is cooling down.
+func (o openaiAuthCache) acquire(ctx context.Context, proxy string) (bool, error) {
+	if o.cooldown == nil {
+		return true, nil
+	}
+	return o.cooldown.Acquire(ctx, proxy, o.lockTTL)
+}
+
+// release lets proxy rest for a random period of the cooldown range.
+func (o openaiAuthCache) release(proxy string) {
+	if o.cooldown == nil {
+		return
+	}
+
+	d := o.cooldownMin
+	if o.cooldownMax > o.cooldownMin {
+		d += time.Duration(rand.Int63n(int64(o.cooldownMax - o.cooldownMin)))
+	}
+	if err := o.cooldown.Release(context.Background(), proxy, d); err != nil {
+		o.logger.Error(fmt.Sprintf("api: cannot release proxy: %s", err))
 	}
-	return resp, nil
 }
 
-func NewOpenaiAuthCache(proxySvc akt.ProxyService, svc akt.OpenaiAuthService, akStore akt.AccessTokenStore, logger log.Logger) akt.OpenaiAuthService {
-	return &openaiAuthCache{
-		proxySvc: proxySvc,
-		svc:      svc,
-		akStore:  akStore,
-		logger:   logger.WithField("auth", "service"),
+// record records a login made through proxy in the proxy stats.
+func (o openaiAuthCache) record(ctx context.Context, proxy, profile string, latency time.Duration, err error) {
+	if o.statsSvc == nil {
+		return
+	}
+
+	if err := o.statsSvc.Record(ctx, proxy, profile, latency, err); err != nil {
+		o.logger.Error(fmt.Sprintf("api: cannot record proxy stats: %s", err))
+	}
+}
+
+// quarantineProxy keeps proxy out of the pool after a login failed through it.
+func (o openaiAuthCache) quarantineProxy(ctx context.Context, proxy string, err error) {
+	if o.quarantine == nil {
+		return
+	}
+
+	o.logger.WithField("ttl", o.quarantineTTL).Info(fmt.Sprintf("api: quarantine proxy: %s", err))
+	if err := o.quarantine.Quarantine(ctx, proxy, o.quarantineTTL); err != nil {
+		o.logger.Error(fmt.Sprintf("api: cannot quarantine proxy: %s", err))
+	}
+}
+
+// wait blocks until the replica holding the login lock of email has stored its token.
+func (o openaiAuthCache) wait(ctx context.Context, email, key string) (*akt.AuthExpireResult, error) {
+	ticker := time.NewTicker(o.poll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		if res, ok := o.lookup(ctx, email); ok {
+			return res, nil
+		}
+
+		token, err := o.locker.Lock(ctx, key, o.lockTTL)
+		if err != nil {
+			return nil, err
+		}
+		if token == "" {
+			continue
+		}
+		o.locker.Unlock(context.Background(), key, token)
+
+		// the lock was released, the token is there unless the other login failed.
+		if res, ok := o.lookup(ctx, email); ok {
+			return res, nil
+		}
+		return nil, fmt.Errorf("api: login %s failed on another replica", email)
+	}
+}
+
+func NewOpenaiAuthCache(proxySvc akt.ProxyService, svc akt.OpenaiAuthService, akStore akt.AccessTokenStore, logger log.Logger, opts ...CacheOption) akt.OpenaiAuthService {
+	o := &openaiAuthCache{
+		proxySvc:      proxySvc,
+		svc:           svc,
+		akStore:       akStore,
+		logger:        logger.WithField("auth", "service"),
+		fallbackTTL:   14 * 24 * time.Hour,
+		flight:        new(singleflight.Group),
+		lockTTL:       2 * time.Minute,
+		poll:          500 * time.Millisecond,
+		scheduler:     new(randomScheduler),
+		retryAttempts: 1,
+	}
+	for _, opt := range opts {
+		opt(o)
 	}
+	return o
 }
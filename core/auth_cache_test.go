@@ -0,0 +1,565 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+	"github.com/workpieces/log"
+
+	akt "github.com/chatgpt-accesstoken"
+	errors2 "github.com/chatgpt-accesstoken/errors"
+)
+
+// countingAuthService logs every request in after delay and counts the logins.
+type countingAuthService struct {
+	calls int32
+	delay time.Duration
+	err   error
+
+	lock  sync.Mutex
+	proxy string
+	mfa   string
+	// errs fails the logins through a proxy.
+	errs map[string]error
+}
+
+func (s *countingAuthService) login(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	atomic.AddInt32(&s.calls, 1)
+	s.lock.Lock()
+	s.proxy = req.Proxy
+	s.mfa = req.MFA
+	err := s.err
+	if e, ok := s.errs[req.Proxy]; ok {
+		err = e
+	}
+	s.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(s.delay):
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &auth.AuthResult{AccessToken: "token-" + req.Email, PUID: "puid"}, nil
+}
+
+func (s *countingAuthService) All(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	return s.login(ctx, req)
+}
+
+func (s *countingAuthService) AccessToken(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	return s.login(ctx, req)
+}
+
+func (s *countingAuthService) PUID(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	if _, err := s.login(ctx, req); err != nil {
+		return nil, err
+	}
+	return &auth.AuthResult{AccessToken: req.AccessToken, PUID: "puid-" + req.AccessToken}, nil
+}
+
+func newTestProxyService(t *testing.T) akt.ProxyService {
+	t.Helper()
+	proxySvc := NewProxyLocalService()
+	if err := proxySvc.Add(context.Background(), "http://a:b@127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	return proxySvc
+}
+
+// concurrently calls AccessToken n times and returns the errors.
+func concurrently(svc akt.OpenaiAuthService, n int) []error {
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = svc.AccessToken(context.Background(), &akt.OpenaiAuthRequest{
+				Email:    "a@b.c",
+				Password: "secret",
+			})
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestOpenaiAuthCacheCoalesce(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "success"},
+		{name: "failure", err: errors.New("upstream failure")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &countingAuthService{delay: 100 * time.Millisecond, err: tt.err}
+			svc := NewOpenaiAuthCache(newTestProxyService(t), upstream, NewAccessTokenStore(), log.NewNop())
+
+			for _, err := range concurrently(svc, 10) {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("Want error %v, got %v", tt.err, err)
+				}
+			}
+			if got, want := atomic.LoadInt32(&upstream.calls), int32(1); got != want {
+				t.Errorf("Want %d upstream login, got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestOpenaiAuthCacheLeaderCancel(t *testing.T) {
+	upstream := &countingAuthService{delay: 200 * time.Millisecond}
+	svc := NewOpenaiAuthCache(newTestProxyService(t), upstream, NewAccessTokenStore(), log.NewNop())
+	req := &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := svc.AccessToken(ctx, req)
+		leader <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	follower := make(chan error, 1)
+	go func() {
+		res, err := svc.AccessToken(context.Background(), req)
+		if err == nil && res.AccessToken != "token-a@b.c" {
+			err = fmt.Errorf("unexpected token %q", res.AccessToken)
+		}
+		follower <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Errorf("Want leader error %v, got %v", context.Canceled, err)
+	}
+	if err := <-follower; err != nil {
+		t.Errorf("Want follower token, got error %v", err)
+	}
+	if got, want := atomic.LoadInt32(&upstream.calls), int32(1); got != want {
+		t.Errorf("Want %d upstream login, got %d", want, got)
+	}
+}
+
+func TestOpenaiAuthCacheCoalesceReplicas(t *testing.T) {
+	db, _ := newTestRedis(t)
+	upstream := &countingAuthService{delay: 200 * time.Millisecond}
+	akStore := NewAccessTokenRedisStore(db, 0)
+	proxySvc := NewProxyService(db)
+	if err := proxySvc.Add(context.Background(), "http://a:b@127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		svc := NewOpenaiAuthCache(proxySvc, upstream, akStore, log.NewNop(), WithLocker(NewLocker(db), time.Minute))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, err := range concurrently(svc, 5) {
+				if err != nil {
+					t.Errorf("Want shared token, got error %s", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := atomic.LoadInt32(&upstream.calls), int32(1); got != want {
+		t.Errorf("Want %d upstream login, got %d", want, got)
+	}
+}
+
+func TestLocker(t *testing.T) {
+	db, s := newTestRedis(t)
+	ctx := context.Background()
+	a, b := NewLocker(db), NewLocker(db)
+
+	first, err := a.Lock(ctx, "a@b.c", time.Second)
+	if err != nil || first == "" {
+		t.Fatalf("Want lock obtained, got %q, %v", first, err)
+	}
+	if token, _ := b.Lock(ctx, "a@b.c", time.Second); token != "" {
+		t.Errorf("Want lock held by another replica")
+	}
+
+	// the lock expires while its first holder is still working.
+	s.FastForward(2 * time.Second)
+	second, err := b.Lock(ctx, "a@b.c", time.Minute)
+	if err != nil || second == "" {
+		t.Fatalf("Want expired lock obtained, got %q, %v", second, err)
+	}
+	if err := a.Unlock(ctx, "a@b.c", first); err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := a.Lock(ctx, "a@b.c", time.Minute); token != "" {
+		t.Errorf("Want lock still held by its second holder")
+	}
+
+	if err := b.Unlock(ctx, "a@b.c", second); err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := a.Lock(ctx, "a@b.c", time.Minute); token == "" {
+		t.Errorf("Want lock released by its holder")
+	}
+
+	// only the holder extends the lock.
+	third, _ := a.Lock(ctx, "b@c.d", time.Second)
+	if ok, err := b.Extend(ctx, "b@c.d", "other", time.Minute); err != nil || ok {
+		t.Errorf("Want lock not extended by another replica, got %v, %v", ok, err)
+	}
+	if ok, err := a.Extend(ctx, "b@c.d", third, time.Minute); err != nil || !ok {
+		t.Fatalf("Want lock extended by its holder, got %v, %v", ok, err)
+	}
+	s.FastForward(2 * time.Second)
+	if token, _ := b.Lock(ctx, "b@c.d", time.Minute); token != "" {
+		t.Errorf("Want extended lock still held")
+	}
+}
+
+func TestOpenaiAuthCachePassword(t *testing.T) {
+	upstream := new(countingAuthService)
+	svc := NewOpenaiAuthCache(newTestProxyService(t), upstream, NewAccessTokenStore(), log.NewNop())
+	ctx := context.Background()
+
+	if _, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		want     error
+	}{
+		{password: "secret"},
+		{password: "guess", want: errors2.ErrPasswordMismatch},
+		{password: "", want: errors2.ErrPasswordMismatch},
+	}
+	for _, tt := range tests {
+		_, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: tt.password})
+		if err != tt.want {
+			t.Errorf("Want error %v with password %q, got %v", tt.want, tt.password, err)
+		}
+	}
+
+	if got, want := atomic.LoadInt32(&upstream.calls), int32(1); got != want {
+		t.Errorf("Want %d upstream login, got %d", want, got)
+	}
+}
+
+func TestOpenaiAuthCachePUID(t *testing.T) {
+	upstream := new(countingAuthService)
+	svc := NewOpenaiAuthCache(newTestProxyService(t), upstream, NewAccessTokenStore(), log.NewNop())
+	ctx := context.Background()
+
+	// a@b.c has a cached token, the puid callers only prove their own access token.
+	if _, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"first", "second", "second"} {
+		for _, email := range []string{"a@b.c", ""} {
+			res, err := svc.PUID(ctx, &akt.OpenaiAuthRequest{Email: email, AccessToken: token})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.AccessToken != token || res.PUID != "puid-"+token {
+				t.Errorf("Want the puid of %s, got %+v", token, res)
+			}
+		}
+	}
+	if got, want := atomic.LoadInt32(&upstream.calls), int32(7); got != want {
+		t.Errorf("Want %d upstream calls, got %d", want, got)
+	}
+}
+
+func TestOpenaiAuthCacheForceRefresh(t *testing.T) {
+	upstream := new(countingAuthService)
+	akStore := NewAccessTokenStore()
+	svc := NewOpenaiAuthCache(newTestProxyService(t), upstream, akStore, log.NewNop())
+	ctx := context.Background()
+
+	for _, force := range []bool{false, false, true} {
+		req := &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret", ForceRefresh: force}
+		if _, err := svc.AccessToken(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := atomic.LoadInt32(&upstream.calls), int32(2); got != want {
+		t.Errorf("Want %d upstream logins, got %d", want, got)
+	}
+
+	// a forced login with another password never reaches the upstream.
+	if _, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "guess", ForceRefresh: true}); err != errors2.ErrPasswordMismatch {
+		t.Errorf("Want password mismatch forcing a login, got %v", err)
+	}
+	if got, want := atomic.LoadInt32(&upstream.calls), int32(2); got != want {
+		t.Errorf("Want %d upstream logins, got %d", want, got)
+	}
+
+	if err := akStore.Delete(ctx, "a@b.c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := atomic.LoadInt32(&upstream.calls), int32(3); got != want {
+		t.Errorf("Want %d upstream logins once evicted, got %d", want, got)
+	}
+}
+
+func TestOpenaiAuthCacheStale(t *testing.T) {
+	upstream := new(countingAuthService)
+	notifier := new(recordingNotifier)
+	// every token is cached expired.
+	svc := NewOpenaiAuthCache(newTestProxyService(t), upstream, NewAccessTokenStore(), log.NewNop(),
+		WithFallbackTTL(-time.Minute), WithStaleGrace(time.Hour, time.Hour), WithRevalidateNotifier(notifier))
+	ctx := context.Background()
+
+	// waitCalls waits for the background refresh in flight, joining it.
+	waitCalls := func(want int32) {
+		t.Helper()
+		svc.(*openaiAuthCache).flight.Do("access_token:a@b.c", func() (interface{}, error) { return nil, nil })
+		if got := atomic.LoadInt32(&upstream.calls); got != want {
+			t.Fatalf("Want %d upstream logins, got %d", want, got)
+		}
+	}
+
+	if _, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, trace := akt.WithLoginTrace(ctx)
+	if _, err := svc.AccessToken(c, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if !trace.Stale() {
+		t.Errorf("Want the expired token served stale")
+	}
+	waitCalls(2)
+
+	upstream.lock.Lock()
+	upstream.err = errors.New("upstream is down")
+	upstream.lock.Unlock()
+
+	grace := 0
+	if _, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret", StaleGrace: &grace}); err == nil {
+		t.Errorf("Want error of the login when the request disables the grace")
+	}
+	waitCalls(3)
+
+	c, trace = akt.WithLoginTrace(ctx)
+	res, err := svc.AccessToken(c, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"})
+	if err != nil {
+		t.Fatalf("Want the stale token served while the refresh fails, got error %s", err)
+	}
+	if got, want := res.AccessToken, "token-a@b.c"; got != want || !trace.Stale() {
+		t.Errorf("Want stale token %q, got %q", want, got)
+	}
+	waitCalls(4)
+
+	if _, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "guess"}); err != errors2.ErrPasswordMismatch {
+		t.Errorf("Want password mismatch serving a stale token, got %v", err)
+	}
+
+	// only the background refreshes are notified by the cache.
+	var types []string
+	for _, event := range notifier.events {
+		types = append(types, event.Type)
+	}
+	if want := []string{akt.EventTokenRefreshed, akt.EventTokenFailed}; fmt.Sprint(types) != fmt.Sprint(want) {
+		t.Errorf("Want events %v, got %v", want, types)
+	}
+}
+
+func TestOpenaiAuthCacheProxyBinding(t *testing.T) {
+	ctx := context.Background()
+	proxySvc := NewProxyLocalService()
+	for _, proxy := range []string{"http://a:b@127.0.0.1:1", "http://a:b@127.0.0.1:2"} {
+		if err := proxySvc.Add(ctx, proxy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upstream := new(countingAuthService)
+	akStore := NewAccessTokenStore()
+	bindingSvc := NewProxyLocalBindingService()
+	svc := NewOpenaiAuthCache(proxySvc, upstream, akStore, log.NewNop(),
+		WithProxyBinding(bindingSvc),
+		WithQuarantine(NewProxyLocalQuarantine(), time.Minute),
+	)
+
+	// login forgets the cached token and logs a@b.c in, returning the proxy used.
+	login := func() (string, error) {
+		akStore.Delete(ctx, "a@b.c")
+		_, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"})
+		upstream.lock.Lock()
+		defer upstream.lock.Unlock()
+		return upstream.proxy, err
+	}
+
+	first, err := login()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bound, _ := bindingSvc.Get(ctx, "a@b.c"); bound != first {
+		t.Errorf("Want a@b.c bound to %s, got %s", first, bound)
+	}
+
+	for i := 0; i < 5; i++ {
+		if got, _ := login(); got != first {
+			t.Fatalf("Want bound proxy %s reused, got %s", first, got)
+		}
+	}
+
+	// a proxy failure quarantines the bound proxy, the next login moves to the other one.
+	upstream.err = OError{Err: auth.NewError("part_one", 403, "blocked", errors.New("error: Check details"))}
+	if _, err := login(); err == nil {
+		t.Fatal("Want login failure")
+	}
+	upstream.err = nil
+
+	second, err := login()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Errorf("Want quarantined proxy %s replaced", first)
+	}
+
+	// deleting the bound proxy leaves only the quarantined one.
+	if err := proxySvc.Delete(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := login(); err == nil {
+		t.Errorf("Want error when the only remaining proxy is quarantined")
+	}
+}
+
+func TestOpenaiAuthCacheCooldown(t *testing.T) {
+	svc := NewOpenaiAuthCache(newTestProxyService(t), new(countingAuthService), NewAccessTokenStore(), log.NewNop(),
+		WithCooldown(NewProxyLocalCooldown(), 300*time.Millisecond, 300*time.Millisecond),
+	)
+
+	start := time.Now()
+	for _, email := range []string{"a@b.c", "d@e.f"} {
+		if _, err := svc.AccessToken(context.Background(), &akt.OpenaiAuthRequest{Email: email}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if took := time.Since(start); took < 300*time.Millisecond {
+		t.Errorf("Want second login to wait for the proxy cooldown, took %s", took)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "g@h.i"}); err != context.DeadlineExceeded {
+		t.Errorf("Want deadline exceeded while the proxy cools down, got %v", err)
+	}
+}
+
+func TestProxyCooldown(t *testing.T) {
+	db, s := newTestRedis(t)
+	ctx := context.Background()
+	cooldown := NewProxyCooldown(db)
+
+	if ok, err := cooldown.Acquire(ctx, "http://a:b@127.0.0.1:1", time.Minute); !ok || err != nil {
+		t.Fatalf("Want proxy acquired, got %v, %v", ok, err)
+	}
+	if ok, _ := cooldown.Acquire(ctx, "http://a:b@127.0.0.1:1", time.Minute); ok {
+		t.Errorf("Want proxy in use not acquired")
+	}
+
+	if err := cooldown.Release(ctx, "http://a:b@127.0.0.1:1", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := cooldown.Acquire(ctx, "http://a:b@127.0.0.1:1", time.Minute); ok {
+		t.Errorf("Want proxy cooling down not acquired")
+	}
+
+	s.FastForward(5 * time.Second)
+	if ok, _ := cooldown.Acquire(ctx, "http://a:b@127.0.0.1:1", time.Minute); !ok {
+		t.Errorf("Want proxy acquired once rested")
+	}
+}
+
+func TestOpenaiAuthCacheRetry(t *testing.T) {
+	const first, second = "http://a:b@127.0.0.1:1", "http://a:b@127.0.0.1:2"
+	blocked := OError{Err: auth.NewError("part_one", 403, "blocked", errors.New("error: Check details"))}
+	wrong := OError{Err: auth.NewError("part_four", 400, "wrong email or password", errors.New("error: Check details"))}
+
+	tests := []struct {
+		name     string
+		errs     map[string]error
+		wantErr  bool
+		attempts int
+	}{
+		{name: "blocked proxy", errs: map[string]error{first: blocked}, attempts: 0},
+		{name: "every proxy blocked", errs: map[string]error{first: blocked, second: blocked}, wantErr: true, attempts: 2},
+		{name: "wrong password", errs: map[string]error{first: wrong, second: wrong}, wantErr: true, attempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			proxySvc := NewProxyLocalService()
+			for _, proxy := range []string{first, second} {
+				if err := proxySvc.Add(ctx, proxy); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			upstream := &countingAuthService{errs: tt.errs}
+			svc := NewOpenaiAuthCache(proxySvc, upstream, NewAccessTokenStore(), log.NewNop(),
+				WithQuarantine(NewProxyLocalQuarantine(), time.Minute),
+				WithRetry(3, 10*time.Millisecond),
+			)
+
+			ctx, trace := akt.WithLoginTrace(ctx)
+			req := &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"}
+			_, err := svc.AccessToken(ctx, req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Want error %v, got %v", tt.wantErr, err)
+			}
+			if req.Proxy != "" {
+				t.Errorf("Want request proxy untouched, got %s", req.Proxy)
+			}
+
+			attempts := trace.Attempts()
+			if got := int(atomic.LoadInt32(&upstream.calls)); got != len(attempts) {
+				t.Errorf("Want %d logins traced, got %d", got, len(attempts))
+			}
+			if tt.attempts > 0 && len(attempts) != tt.attempts {
+				t.Errorf("Want %d attempts, got %d", tt.attempts, len(attempts))
+			}
+			if !tt.wantErr && attempts[len(attempts)-1].ProxyID != akt.ProxyID(second) {
+				t.Errorf("Want login served by %s, got %v", akt.ProxyID(second), trace.Proxies())
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"time"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+)
+
+type openaiAuthNotifier struct {
+	notifier akt.Notifier
+	svc      akt.OpenaiAuthService
+}
+
+// NewOpenaiAuthNotifier returns an OpenaiAuthService notifying the outcome
+// of every request of svc which logged in upstream. It goes outside the
+// cache, so that the cached tokens served are not notified and the proxies
+// retried by a single request make a single event.
+func NewOpenaiAuthNotifier(notifier akt.Notifier, svc akt.OpenaiAuthService) akt.OpenaiAuthService {
+	return &openaiAuthNotifier{notifier: notifier, svc: svc}
+}
+
+func (o openaiAuthNotifier) All(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	ctx, trace := traced(ctx)
+	resp, err := o.svc.All(ctx, req)
+	o.notify(ctx, req, trace, err)
+	return resp, err
+}
+
+func (o openaiAuthNotifier) AccessToken(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	ctx, trace := traced(ctx)
+	resp, err := o.svc.AccessToken(ctx, req)
+	o.notify(ctx, req, trace, err)
+	return resp, err
+}
+
+func (o openaiAuthNotifier) PUID(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	return o.svc.PUID(ctx, req)
+}
+
+// traced returns ctx recording the logins of the request, with the trace of the caller if any.
+func traced(ctx context.Context) (context.Context, *akt.LoginTrace) {
+	if trace := akt.LoginTraceFrom(ctx); trace != nil {
+		return ctx, trace
+	}
+	return akt.WithLoginTrace(ctx)
+}
+
+func (o openaiAuthNotifier) notify(ctx context.Context, req *akt.OpenaiAuthRequest, trace *akt.LoginTrace, err error) {
+	notifyLogin(ctx, o.notifier, req.Email, trace, err)
+}
+
+// notifyLogin notifies the outcome of the logins of email in trace.
+func notifyLogin(ctx context.Context, notifier akt.Notifier, email string, trace *akt.LoginTrace, err error) {
+	attempts := trace.Attempts()
+	if len(attempts) == 0 {
+		// served from the cache.
+		return
+	}
+
+	event := &akt.Event{
+		ID:      newID(),
+		Email:   email,
+		ProxyID: attempts[len(attempts)-1].ProxyID,
+		Time:    time.Now(),
+	}
+
+	switch {
+	case err != nil:
+		event.Type = akt.EventTokenFailed
+		event.Code = errorCode(err)
+		event.Error = err.Error()
+	case trace.Refreshed():
+		event.Type = akt.EventTokenRefreshed
+	default:
+		event.Type = akt.EventTokenIssued
+	}
+	notifier.Notify(ctx, event)
+
+	if event.Code == errors.CodeAccountBanned {
+		banned := *event
+		banned.ID = newID()
+		banned.Type = akt.EventAccountBanned
+		notifier.Notify(ctx, &banned)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+
+	akt "github.com/chatgpt-accesstoken"
+	errors2 "github.com/chatgpt-accesstoken/errors"
+)
+
+func TestOpenaiAuthServiceTimeout(t *testing.T) {
+	inflight := NewInflight()
+	s := New(WithLoginTimeout(50*time.Millisecond), WithInflight(inflight)).(*openaiAuthService)
+
+	release := make(chan struct{})
+	start := time.Now()
+	err := s.run(context.Background(), func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	if err != errors2.ErrLoginTimeout {
+		t.Errorf("Want login timeout, got %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Want login given up after the timeout, took %s", took)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := inflight.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Want drain to wait for the running login, got %v", err)
+	}
+
+	// no login starts once the drain began.
+	if err := s.run(context.Background(), func(ctx context.Context) error { return nil }); err != errors2.ErrShuttingDown {
+		t.Errorf("Want login refused while draining, got %v", err)
+	}
+
+	close(release)
+	if err := inflight.Wait(context.Background()); err != nil {
+		t.Errorf("Want drain done, got %v", err)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 test vectors truncated to 6 digits, the secret is "12345678901234567890".
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 2000000000, want: "279037"},
+	}
+	for _, tt := range tests {
+		got, err := TOTP("gezdgnbvgy3tqojq gezdgnbvgy3tqojq", time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Want code %s at %d, got %s", tt.want, tt.unix, got)
+		}
+	}
+
+	if _, err := TOTP("not base32!", time.Now()); err == nil {
+		t.Errorf("Want error of an invalid secret")
+	}
+}
+
+// mfaUpstream redirects the resume of the login to the one-time code
+// challenge, which accepts the current code of secret and resumes the
+// login again up to the callback.
+type mfaUpstream struct {
+	tls_client.HttpClient
+	secret string
+}
+
+func (u *mfaUpstream) Do(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{StatusCode: http.StatusFound, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}
+	switch {
+	case req.URL.Path == mfaChallengePath:
+		body, _ := io.ReadAll(req.Body)
+		form, _ := url.ParseQuery(string(body))
+		now, _ := TOTP(u.secret, time.Now())
+		before, _ := TOTP(u.secret, time.Now().Add(-totpPeriod))
+		if form.Get("state") != "abc" || (form.Get("code") != now && form.Get("code") != before) {
+			resp.StatusCode = http.StatusBadRequest
+			return resp, nil
+		}
+		resp.Header.Set("Location", "/authorize/resume?state=def")
+	case req.URL.Query().Get("state") == "def":
+		resp.Header.Set("Location", "com.openai.chat://auth0.openai.com/ios/com.openai.chat/callback?code=xyz&state=def")
+	default:
+		resp.Header.Set("Location", mfaChallengePath+"?state=abc")
+	}
+	return resp, nil
+}
+
+func TestMFASession(t *testing.T) {
+	upstream := &mfaUpstream{secret: "JBSWY3DPEHPK3PXP"}
+	tests := []struct {
+		name     string
+		secret   string
+		want     error
+		location string
+	}{
+		{name: "accepted", secret: "JBSWY3DPEHPK3PXP", location: "com.openai.chat://auth0.openai.com/ios/com.openai.chat/callback?code=xyz&state=def"},
+		{name: "rejected", secret: "GEZDGNBVGY3TQOJQ", want: errors2.ErrMFARejected},
+		{name: "required", want: errors2.ErrMFARequired, location: mfaChallengePath + "?state=abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &mfaSession{HttpClient: upstream, secret: tt.secret}
+			req, _ := http.NewRequest(http.MethodGet, "https://auth0.openai.com/authorize/resume?state=abc", nil)
+			resp, err := s.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.err != tt.want {
+				t.Errorf("Want error %v, got %v", tt.want, s.err)
+			}
+			if got := resp.Header.Get("Location"); tt.location != "" && got != tt.location {
+				t.Errorf("Want redirect to %s, got %s", tt.location, got)
+			}
+		})
+	}
+}
+
+func TestClientProfile(t *testing.T) {
+	proxy := "http://a:b@127.0.0.1:1"
+	proxies := map[string]ClientProfile{
+		akt.ProxyID(proxy): {Name: "chrome_110"},
+	}
+	fallback := ClientProfile{Name: "safari_16_0", UserAgent: "Safari"}
+
+	tests := []struct {
+		name string
+		req  *akt.OpenaiAuthRequest
+		want ClientProfile
+	}{
+		{name: "fallback", req: &akt.OpenaiAuthRequest{}, want: fallback},
+		{name: "proxy", req: &akt.OpenaiAuthRequest{Proxy: proxy}, want: ClientProfile{Name: "chrome_110", UserAgent: "Safari"}},
+		{name: "request", req: &akt.OpenaiAuthRequest{Proxy: proxy, ClientProfile: "opera_90", UserAgent: "Opera"}, want: ClientProfile{Name: "opera_90", UserAgent: "Opera"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientProfile(tt.req, proxies, fallback); got != tt.want {
+				t.Errorf("Want profile %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+
+	if got := clientProfile(&akt.OpenaiAuthRequest{}, nil, ClientProfile{}); got.Name != defaultClientProfile {
+		t.Errorf("Want the default profile %s, got %s", defaultClientProfile, got.Name)
+	}
+
+	if _, err := NewOpenaiAuthenticatorFactory(WithClientProfile(ClientProfile{Name: "netscape_4"})); err == nil {
+		t.Errorf("Want error of an unknown profile")
+	}
+}
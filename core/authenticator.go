@@ -0,0 +1,176 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+	tls_client "github.com/bogdanfinn/tls-client"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+)
+
+type openaiAuthenticatorFactory struct {
+	authURL   string
+	chatURL   string
+	endpoints map[string]*url.URL
+
+	profile ClientProfile
+	proxies map[string]ClientProfile
+}
+
+// AuthenticatorOption configures the openai authenticators.
+type AuthenticatorOption func(*openaiAuthenticatorFactory)
+
+// WithEndpoints sends the requests to auth0.openai.com to authURL and the
+// ones to chat.openai.com to chatURL, an empty url keeps the host.
+func WithEndpoints(authURL, chatURL string) AuthenticatorOption {
+	return func(f *openaiAuthenticatorFactory) {
+		f.authURL = authURL
+		f.chatURL = chatURL
+	}
+}
+
+// WithClientProfile logs in with the tls-client profile and user agent of
+// profile, a request may ask for another one.
+func WithClientProfile(profile ClientProfile) AuthenticatorOption {
+	return func(f *openaiAuthenticatorFactory) {
+		f.profile = profile
+	}
+}
+
+// WithProxyProfiles logs in through each proxy of proxies, given by its
+// address or its id, with its profile instead of the default one.
+func WithProxyProfiles(proxies map[string]ClientProfile) AuthenticatorOption {
+	return func(f *openaiAuthenticatorFactory) {
+		f.proxies = proxies
+	}
+}
+
+// NewOpenaiAuthenticatorFactory returns the AuthenticatorFactory logging in
+// to OpenAI through acheong08/OpenAIAuth.
+func NewOpenaiAuthenticatorFactory(opts ...AuthenticatorOption) (akt.AuthenticatorFactory, error) {
+	f := new(openaiAuthenticatorFactory)
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	var err error
+	f.endpoints, err = parseEndpoints(f.authURL, f.chatURL)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := []ClientProfile{f.profile}
+	for _, p := range f.proxies {
+		profiles = append(profiles, p)
+	}
+	for _, p := range profiles {
+		if p.Name == "" {
+			continue
+		}
+		if err := validClientProfile(p.Name); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *openaiAuthenticatorFactory) New(req *akt.OpenaiAuthRequest) akt.Authenticator {
+	return &openaiAuthenticator{
+		req:           req,
+		authenticator: auth.NewAuthenticator(req.Email, req.Password, req.Proxy),
+		endpoints:     f.endpoints,
+		profile:       clientProfile(req, f.proxies, f.profile),
+	}
+}
+
+type openaiAuthenticator struct {
+	req           *akt.OpenaiAuthRequest
+	authenticator *auth.Authenticator
+	endpoints     map[string]*url.URL
+	profile       ClientProfile
+}
+
+func (a *openaiAuthenticator) Login(ctx context.Context) (*auth.AuthResult, error) {
+	mfa, err := a.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.authenticator.Begin(); err != nil {
+		if mfa.err != nil {
+			return nil, mfa.err
+		}
+		return nil, OError{Err: err}
+	}
+
+	res := a.authenticator.GetAuthResult()
+	return &res, nil
+}
+
+func (a *openaiAuthenticator) PUID(ctx context.Context) (string, error) {
+	if _, err := a.session(ctx); err != nil {
+		return "", err
+	}
+	a.authenticator.AuthResult.AccessToken = a.req.AccessToken
+
+	puid, err := a.authenticator.GetPUID()
+	if err != nil {
+		return "", OError{Err: err}
+	}
+	return puid, nil
+}
+
+// session sends the upstream requests through the proxy with the client
+// profile, binds them to ctx, sends them to the endpoints, and answers the
+// one-time code challenge with the TOTP code of the MFA secret of the request.
+func (a *openaiAuthenticator) session(ctx context.Context) (*mfaSession, error) {
+	if err := validClientProfile(a.profile.Name); err != nil {
+		return nil, err
+	}
+	proxy := a.req.Proxy
+	if proxy != "" {
+		var err error
+		if proxy, err = akt.ParseProxy(proxy); err != nil {
+			return nil, err
+		}
+	}
+	client, err := newSession(a.profile.Name, proxy)
+	if err != nil {
+		return nil, errors.NewCode(errors.CodeProxy, fmt.Sprintf("proxy: %s", err))
+	}
+	if a.profile.UserAgent != "" {
+		a.authenticator.UserAgent = a.profile.UserAgent
+	}
+	reportProfile(ctx, a.profile.Name)
+
+	var session tls_client.HttpClient = &contextSession{HttpClient: client, ctx: ctx}
+	if len(a.endpoints) > 0 {
+		session = &endpointSession{HttpClient: session, endpoints: a.endpoints}
+	}
+
+	mfa := &mfaSession{
+		HttpClient: session,
+		secret:     a.req.MFA,
+	}
+	a.authenticator.Session = mfa
+	return mfa, nil
+}
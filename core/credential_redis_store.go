@@ -0,0 +1,69 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+	"github.com/chatgpt-accesstoken/store/redisdb"
+)
+
+// credentialKey is the redis hash of the password of each email.
+const credentialKey = "akt:credential"
+
+type credentialRedisStore struct {
+	db *redisdb.Redis
+}
+
+func NewCredentialRedisStore(db *redisdb.Redis) akt.CredentialStore {
+	return &credentialRedisStore{db: db}
+}
+
+func (c *credentialRedisStore) Get(ctx context.Context, email string) (string, error) {
+	password, err := c.db.HGet(credentialKey, email)
+	if err != nil {
+		return "", err
+	}
+
+	if password == "" {
+		return "", errors.ErrNotFound
+	}
+	return password, nil
+}
+
+func (c *credentialRedisStore) Set(ctx context.Context, email, password string) error {
+	return c.db.HSet(credentialKey, email, password)
+}
+
+func (c *credentialRedisStore) Delete(ctx context.Context, email string) error {
+	return c.db.HDel(credentialKey, email)
+}
+
+func (c *credentialRedisStore) List(ctx context.Context) ([]string, error) {
+	all, err := c.db.HGetAll(credentialKey)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]string, 0, len(all))
+	for email := range all {
+		list = append(list, email)
+	}
+	return list, nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"sync"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+)
+
+type credentialStore struct {
+	db   map[string]string
+	lock sync.RWMutex
+}
+
+func NewCredentialStore() akt.CredentialStore {
+	return &credentialStore{
+		db: make(map[string]string),
+	}
+}
+
+func (c *credentialStore) Get(ctx context.Context, email string) (string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	password, ok := c.db[email]
+	if !ok {
+		return "", errors.ErrNotFound
+	}
+	return password, nil
+}
+
+func (c *credentialStore) Set(ctx context.Context, email, password string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.db[email] = password
+	return nil
+}
+
+func (c *credentialStore) Delete(ctx context.Context, email string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.db, email)
+	return nil
+}
+
+func (c *credentialStore) List(ctx context.Context) ([]string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	list := make([]string, 0, len(c.db))
+	for email := range c.db {
+		list = append(list, email)
+	}
+	return list, nil
+}
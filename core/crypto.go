@@ -0,0 +1,183 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// sealedPrefix starts every value sealed by a Keyring.
+const sealedPrefix = "enc:v1:"
+
+// Keyring seals values with envelope encryption: each value is encrypted
+// with its own random data key, itself encrypted with a master key. The
+// id of the master key is kept with the value so that the master key can
+// be rotated.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring returns a Keyring of the master keys in spec, a comma or
+// newline separated list of id:base64-key. The first key seals the new
+// values, the others only open the values sealed before a rotation.
+func NewKeyring(spec string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for i, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("keyring: cannot parse key #%d, want id:base64-key", i+1)
+		}
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("keyring: duplicate key %s", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("keyring: cannot decode key %s: %w", id, err)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("keyring: key %s: %w", id, err)
+		}
+
+		k.keys[id] = aead
+		if k.current == "" {
+			k.current = id
+		}
+	}
+
+	if k.current == "" {
+		return nil, fmt.Errorf("keyring: no master key")
+	}
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts plaintext with a new data key under the current master key.
+func (k *Keyring) Seal(plaintext []byte) (string, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := sealAEAD(k.keys[k.current], dek)
+	if err != nil {
+		return "", err
+	}
+	data, err := sealAEAD(aead, plaintext)
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + k.current + ":" + wrapped + ":" + data, nil
+}
+
+// Open decrypts a value sealed by Seal with any master key of the keyring.
+func (k *Keyring) Open(sealed string) ([]byte, error) {
+	id, wrapped, data, err := parseSealed(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	master, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("keyring: unknown key %s", id)
+	}
+	dek, err := openAEAD(master, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	return openAEAD(aead, data)
+}
+
+// open returns the plaintext of value, values stored before the encryption
+// was enabled are returned as is.
+func (k *Keyring) open(value string) (string, error) {
+	if !Sealed(value) {
+		return value, nil
+	}
+	plaintext, err := k.Open(value)
+	return string(plaintext), err
+}
+
+// Current reports whether value is sealed under the current master key.
+func (k *Keyring) Current(value string) bool {
+	id, _, _, err := parseSealed(value)
+	return err == nil && id == k.current
+}
+
+// Sealed reports whether value was sealed by a Keyring.
+func Sealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+func parseSealed(sealed string) (id, wrapped, data string, err error) {
+	parts := strings.Split(strings.TrimPrefix(sealed, sealedPrefix), ":")
+	if !Sealed(sealed) || len(parts) != 3 {
+		return "", "", "", fmt.Errorf("keyring: malformed sealed value")
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// sealAEAD returns the base64 nonce and ciphertext of plaintext.
+func sealAEAD(aead cipher.AEAD, plaintext []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func openAEAD(aead cipher.AEAD, sealed string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, fmt.Errorf("keyring: malformed sealed value")
+	}
+	plaintext, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("keyring: cannot decrypt: %w", err)
+	}
+	return plaintext, nil
+}
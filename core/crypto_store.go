@@ -0,0 +1,454 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+
+	akt "github.com/chatgpt-accesstoken"
+)
+
+type encryptedAccessTokenStore struct {
+	store   akt.AccessTokenStore
+	keyring *Keyring
+}
+
+// NewEncryptedAccessTokenStore returns an AccessTokenStore sealing the
+// tokens before they reach store. The expiry and the password hash are
+// kept in clear for the store to expire the entries and the cache to
+// check the password.
+func NewEncryptedAccessTokenStore(store akt.AccessTokenStore, keyring *Keyring) akt.AccessTokenStore {
+	return &encryptedAccessTokenStore{store: store, keyring: keyring}
+}
+
+func (e *encryptedAccessTokenStore) Add(ctx context.Context, email string, ak *akt.AuthExpireResult) error {
+	data, err := json.Marshal(ak.AuthResult)
+	if err != nil {
+		return err
+	}
+	sealed, err := e.keyring.Seal(data)
+	if err != nil {
+		return err
+	}
+
+	return e.store.Add(ctx, email, &akt.AuthExpireResult{
+		AuthResult:   &auth.AuthResult{AccessToken: sealed},
+		Expires:      ak.Expires,
+		PasswordHash: ak.PasswordHash,
+	})
+}
+
+func (e *encryptedAccessTokenStore) Delete(ctx context.Context, email string) error {
+	return e.store.Delete(ctx, email)
+}
+
+func (e *encryptedAccessTokenStore) Get(ctx context.Context, email string) (*akt.AuthExpireResult, error) {
+	res, err := e.store.Get(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if res.AuthResult == nil || !Sealed(res.AccessToken) {
+		// stored before the encryption was enabled.
+		return res, nil
+	}
+
+	data, err := e.keyring.Open(res.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	result := new(auth.AuthResult)
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+
+	return &akt.AuthExpireResult{
+		AuthResult:   result,
+		Expires:      res.Expires,
+		PasswordHash: res.PasswordHash,
+	}, nil
+}
+
+func (e *encryptedAccessTokenStore) List(ctx context.Context) ([]string, error) {
+	return e.store.List(ctx)
+}
+
+type encryptedCredentialStore struct {
+	store   akt.CredentialStore
+	keyring *Keyring
+}
+
+// NewEncryptedCredentialStore returns a CredentialStore sealing the
+// passwords before they reach store.
+func NewEncryptedCredentialStore(store akt.CredentialStore, keyring *Keyring) akt.CredentialStore {
+	return &encryptedCredentialStore{store: store, keyring: keyring}
+}
+
+func (e *encryptedCredentialStore) Get(ctx context.Context, email string) (string, error) {
+	password, err := e.store.Get(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	return e.keyring.open(password)
+}
+
+func (e *encryptedCredentialStore) Set(ctx context.Context, email, password string) error {
+	sealed, err := e.keyring.Seal([]byte(password))
+	if err != nil {
+		return err
+	}
+	return e.store.Set(ctx, email, sealed)
+}
+
+func (e *encryptedCredentialStore) Delete(ctx context.Context, email string) error {
+	return e.store.Delete(ctx, email)
+}
+
+func (e *encryptedCredentialStore) List(ctx context.Context) ([]string, error) {
+	return e.store.List(ctx)
+}
+
+type encryptedAccountService struct {
+	svc     akt.AccountService
+	keyring *Keyring
+}
+
+// NewEncryptedAccountService returns an AccountService sealing the
+// password and the mfa secret of the accounts before they reach svc.
+func NewEncryptedAccountService(svc akt.AccountService, keyring *Keyring) akt.AccountService {
+	return &encryptedAccountService{svc: svc, keyring: keyring}
+}
+
+func (e *encryptedAccountService) List(ctx context.Context) ([]*akt.Account, error) {
+	list, err := e.svc.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, account := range list {
+		if list[i], err = e.open(account); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (e *encryptedAccountService) Get(ctx context.Context, id string) (*akt.Account, error) {
+	account, err := e.svc.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(account)
+}
+
+func (e *encryptedAccountService) Create(ctx context.Context, account *akt.Account) error {
+	sealed, err := e.seal(account)
+	if err != nil {
+		return err
+	}
+	if err := e.svc.Create(ctx, sealed); err != nil {
+		return err
+	}
+
+	account.ID, account.Created, account.Updated = sealed.ID, sealed.Created, sealed.Updated
+	return nil
+}
+
+func (e *encryptedAccountService) Update(ctx context.Context, account *akt.Account) error {
+	sealed, err := e.seal(account)
+	if err != nil {
+		return err
+	}
+	if err := e.svc.Update(ctx, sealed); err != nil {
+		return err
+	}
+
+	account.Created, account.Updated = sealed.Created, sealed.Updated
+	return nil
+}
+
+func (e *encryptedAccountService) Delete(ctx context.Context, id string) error {
+	return e.svc.Delete(ctx, id)
+}
+
+// seal returns a copy of account with its secrets sealed.
+func (e *encryptedAccountService) seal(account *akt.Account) (*akt.Account, error) {
+	v := *account
+	for _, secret := range []*string{&v.Password, &v.MFASecret} {
+		if *secret == "" {
+			continue
+		}
+		sealed, err := e.keyring.Seal([]byte(*secret))
+		if err != nil {
+			return nil, err
+		}
+		*secret = sealed
+	}
+	return &v, nil
+}
+
+// open returns a copy of account with its secrets opened.
+func (e *encryptedAccountService) open(account *akt.Account) (*akt.Account, error) {
+	v := *account
+	for _, secret := range []*string{&v.Password, &v.MFASecret} {
+		opened, err := e.keyring.open(*secret)
+		if err != nil {
+			return nil, err
+		}
+		*secret = opened
+	}
+	return &v, nil
+}
+
+type encryptedJobStore struct {
+	store   akt.JobStore
+	keyring *Keyring
+}
+
+// NewEncryptedJobStore returns a JobStore sealing the password of the
+// queued logins and the tokens of the done ones before they reach store.
+func NewEncryptedJobStore(store akt.JobStore, keyring *Keyring) akt.JobStore {
+	return &encryptedJobStore{store: store, keyring: keyring}
+}
+
+func (e *encryptedJobStore) Push(ctx context.Context, job *akt.Job) error {
+	sealed, err := e.seal(job)
+	if err != nil {
+		return err
+	}
+	return e.store.Push(ctx, sealed)
+}
+
+func (e *encryptedJobStore) Pop(ctx context.Context, timeout time.Duration) (*akt.Job, error) {
+	job, err := e.store.Pop(ctx, timeout)
+	if err != nil || job == nil {
+		return nil, err
+	}
+	return e.open(job)
+}
+
+func (e *encryptedJobStore) Save(ctx context.Context, job *akt.Job) error {
+	sealed, err := e.seal(job)
+	if err != nil {
+		return err
+	}
+	return e.store.Save(ctx, sealed)
+}
+
+func (e *encryptedJobStore) Update(ctx context.Context, job *akt.Job, from string) (bool, error) {
+	sealed, err := e.seal(job)
+	if err != nil {
+		return false, err
+	}
+	return e.store.Update(ctx, sealed, from)
+}
+
+func (e *encryptedJobStore) Requeue(ctx context.Context, job *akt.Job, from string) (bool, error) {
+	sealed, err := e.seal(job)
+	if err != nil {
+		return false, err
+	}
+	return e.store.Requeue(ctx, sealed, from)
+}
+
+func (e *encryptedJobStore) Get(ctx context.Context, id string) (*akt.Job, error) {
+	job, err := e.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(job)
+}
+
+func (e *encryptedJobStore) List(ctx context.Context) ([]string, error) {
+	return e.store.List(ctx)
+}
+
+// secrets returns the secrets of job.
+func secrets(job *akt.Job) []*string {
+	var list []*string
+	if job.Request != nil {
+		list = append(list, &job.Request.Password, &job.Request.MFA)
+	}
+	if job.Result != nil {
+		list = append(list, &job.Result.AccessToken, &job.Result.RefreshToken, &job.Result.PUID)
+	}
+	return list
+}
+
+// seal returns a copy of job with its secrets sealed.
+func (e *encryptedJobStore) seal(job *akt.Job) (*akt.Job, error) {
+	v := copyJob(job)
+	for _, secret := range secrets(v) {
+		if *secret == "" {
+			continue
+		}
+		sealed, err := e.keyring.Seal([]byte(*secret))
+		if err != nil {
+			return nil, err
+		}
+		*secret = sealed
+	}
+	return v, nil
+}
+
+// open returns a copy of job with its secrets opened.
+func (e *encryptedJobStore) open(job *akt.Job) (*akt.Job, error) {
+	v := copyJob(job)
+	for _, secret := range secrets(v) {
+		opened, err := e.keyring.open(*secret)
+		if err != nil {
+			return nil, err
+		}
+		*secret = opened
+	}
+	return v, nil
+}
+
+// copyJob returns a copy of job sharing none of its secrets.
+func copyJob(job *akt.Job) *akt.Job {
+	v := *job
+	if job.Request != nil {
+		req := *job.Request
+		v.Request = &req
+	}
+	if job.Result != nil {
+		res := *job.Result
+		v.Result = &res
+	}
+	return &v
+}
+
+// RotateKeys seals again under the current master key of keyring every
+// entry of the stores sealed under another key or not sealed at all. The
+// stores are the ones the encrypted stores wrap, nil ones are skipped. It
+// returns the number of entries sealed again.
+func RotateKeys(ctx context.Context, keyring *Keyring, akStore akt.AccessTokenStore, credStore akt.CredentialStore, accountSvc akt.AccountService, jobStore akt.JobStore) (int, error) {
+	var n int
+
+	if akStore != nil {
+		enc := NewEncryptedAccessTokenStore(akStore, keyring)
+		emails, err := akStore.List(ctx)
+		if err != nil {
+			return n, err
+		}
+		for _, email := range emails {
+			res, err := akStore.Get(ctx, email)
+			if err != nil {
+				// expired since listed.
+				continue
+			}
+			if res.AuthResult != nil && keyring.Current(res.AccessToken) {
+				continue
+			}
+
+			if res, err = enc.Get(ctx, email); err != nil {
+				return n, err
+			}
+			if err := enc.Add(ctx, email, res); err != nil {
+				if time.Now().After(res.Expires) {
+					// stale entry removed by redis meanwhile.
+					continue
+				}
+				return n, err
+			}
+			n++
+		}
+	}
+
+	if credStore != nil {
+		enc := NewEncryptedCredentialStore(credStore, keyring)
+		emails, err := credStore.List(ctx)
+		if err != nil {
+			return n, err
+		}
+		for _, email := range emails {
+			password, err := credStore.Get(ctx, email)
+			if err != nil {
+				return n, err
+			}
+			if keyring.Current(password) {
+				continue
+			}
+
+			if password, err = enc.Get(ctx, email); err != nil {
+				return n, err
+			}
+			if err := enc.Set(ctx, email, password); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+
+	if accountSvc != nil {
+		enc := &encryptedAccountService{svc: accountSvc, keyring: keyring}
+		list, err := accountSvc.List(ctx)
+		if err != nil {
+			return n, err
+		}
+		for _, account := range list {
+			if (account.Password == "" || keyring.Current(account.Password)) &&
+				(account.MFASecret == "" || keyring.Current(account.MFASecret)) {
+				continue
+			}
+
+			opened, err := enc.open(account)
+			if err != nil {
+				return n, err
+			}
+			if err := enc.Update(ctx, opened); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+
+	if jobStore != nil {
+		enc := &encryptedJobStore{store: jobStore, keyring: keyring}
+		ids, err := jobStore.List(ctx)
+		if err != nil {
+			return n, err
+		}
+		for _, id := range ids {
+			job, err := jobStore.Get(ctx, id)
+			if err != nil {
+				// expired since listed.
+				continue
+			}
+			current := true
+			for _, secret := range secrets(job) {
+				current = current && (*secret == "" || keyring.Current(*secret))
+			}
+			if current {
+				continue
+			}
+
+			opened, err := enc.open(job)
+			if err != nil {
+				return n, err
+			}
+			if err := enc.Save(ctx, opened); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+
+	akt "github.com/chatgpt-accesstoken"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestKeyring(t *testing.T) {
+	old, err := NewKeyring("k1:" + testKey('a'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := old.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "secret") || !old.Current(sealed) {
+		t.Errorf("Want secret sealed under k1, got %s", sealed)
+	}
+
+	rotated, err := NewKeyring("k2:" + testKey('b') + "\nk1:" + testKey('a'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := rotated.Open(sealed); err != nil || string(got) != "secret" {
+		t.Errorf("Want value sealed under k1 opened after rotation, got %q, %v", got, err)
+	}
+	if rotated.Current(sealed) {
+		t.Errorf("Want value sealed under k1 not current after rotation")
+	}
+
+	other, _ := NewKeyring("k1:" + testKey('c'))
+	if _, err := other.Open(sealed); err == nil {
+		t.Errorf("Want error opening with another key")
+	}
+
+	for _, spec := range []string{"", "k1", "k1:not-base64", "k1:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := NewKeyring(spec); err == nil {
+			t.Errorf("Want error parsing keyring %q", spec)
+		}
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	db, s := newTestRedis(t)
+	ctx := context.Background()
+	akStore := NewAccessTokenRedisStore(db, time.Hour)
+	credStore := NewCredentialRedisStore(db)
+	accountSvc := NewAccountService(db)
+
+	// a@b.c is stored before the encryption is enabled, d@e.f under k1.
+	old, _ := NewKeyring("k1:" + testKey('a'))
+	akStore.Add(ctx, "a@b.c", &akt.AuthExpireResult{AuthResult: &auth.AuthResult{AccessToken: "token-a"}, Expires: time.Now().Add(time.Hour)})
+	credStore.Set(ctx, "a@b.c", "secret-a")
+	NewEncryptedAccessTokenStore(akStore, old).Add(ctx, "d@e.f", &akt.AuthExpireResult{AuthResult: &auth.AuthResult{AccessToken: "token-d"}, Expires: time.Now().Add(time.Hour)})
+	NewEncryptedCredentialStore(credStore, old).Set(ctx, "d@e.f", "secret-d")
+	// g@h.i expired but is still kept to be served stale.
+	NewEncryptedAccessTokenStore(akStore, old).Add(ctx, "g@h.i", &akt.AuthExpireResult{AuthResult: &auth.AuthResult{AccessToken: "token-g"}, Expires: time.Now().Add(-time.Minute)})
+	account := &akt.Account{Email: "d@e.f", Password: "secret-d", MFASecret: "JBSWY3DPEHPK3PXP"}
+	if err := NewEncryptedAccountService(accountSvc, old).Create(ctx, account); err != nil {
+		t.Fatal(err)
+	}
+
+	jobStore := NewJobRedisStore(db, time.Hour)
+	job := &akt.Job{ID: "j1", Status: akt.JobPending, Request: &akt.OpenaiAuthRequest{Email: "d@e.f", Password: "secret-d"}}
+	if err := NewEncryptedJobStore(jobStore, old).Push(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, _ := NewKeyring("k2:" + testKey('b') + ",k1:" + testKey('a'))
+	n, err := RotateKeys(ctx, keyring, akStore, credStore, accountSvc, jobStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Errorf("Want 7 entries re-encrypted, got %d", n)
+	}
+	if ttl := s.TTL(accessTokenKey + "g@h.i"); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("Want the stale token kept within the grace, got ttl %s", ttl)
+	}
+	if n, _ := RotateKeys(ctx, keyring, akStore, credStore, accountSvc, jobStore); n != 0 {
+		t.Errorf("Want nothing left to re-encrypt, got %d", n)
+	}
+
+	// the stores only hold values sealed under k2.
+	raw, _ := accountSvc.Get(ctx, account.ID)
+	if !keyring.Current(raw.Password) || !keyring.Current(raw.MFASecret) {
+		t.Errorf("Want account secrets sealed under k2, got %+v", raw)
+	}
+
+	current, _ := NewKeyring("k2:" + testKey('b'))
+	for _, email := range []string{"a@b.c", "d@e.f", "g@h.i"} {
+		if res, err := NewEncryptedAccessTokenStore(akStore, current).Get(ctx, email); err != nil || res.AccessToken != "token-"+email[:1] {
+			t.Errorf("Want token of %s opened with k2, got %+v, %v", email, res, err)
+		}
+		if email == "g@h.i" {
+			continue
+		}
+		if password, err := NewEncryptedCredentialStore(credStore, current).Get(ctx, email); err != nil || password != "secret-"+email[:1] {
+			t.Errorf("Want password of %s opened with k2, got %q, %v", email, password, err)
+		}
+	}
+	if got, err := NewEncryptedAccountService(accountSvc, current).Get(ctx, account.ID); err != nil || got.Password != "secret-d" || got.MFASecret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("Want account opened with k2, got %+v, %v", got, err)
+	}
+	if got, err := NewEncryptedJobStore(jobStore, current).Get(ctx, job.ID); err != nil || got.Request.Password != "secret-d" {
+		t.Errorf("Want queued job opened with k2, got %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+)
+
+// Hosts the upstream login library sends its requests to.
+const (
+	authHost = "auth0.openai.com"
+	chatHost = "chat.openai.com"
+)
+
+// endpointSession sends the requests of the upstream login library to
+// other hosts, such as a local stand-in of OpenAI.
+type endpointSession struct {
+	tls_client.HttpClient
+	endpoints map[string]*url.URL
+}
+
+func (s *endpointSession) Do(req *http.Request) (*http.Response, error) {
+	if base, ok := s.endpoints[req.URL.Host]; ok {
+		u := *req.URL
+		u.Scheme = base.Scheme
+		u.Host = base.Host
+		u.Path = strings.TrimRight(base.Path, "/") + u.Path
+		u.RawPath = ""
+
+		req = req.Clone(req.Context())
+		req.URL = &u
+		req.Host = base.Host
+		req.Header.Del("Host")
+	}
+	return s.HttpClient.Do(req)
+}
+
+// parseEndpoints returns the base urls replacing the auth and chat hosts,
+// an empty url keeps the host.
+func parseEndpoints(authURL, chatURL string) (map[string]*url.URL, error) {
+	endpoints := make(map[string]*url.URL)
+	for host, raw := range map[string]string{authHost: authURL, chatHost: chatURL} {
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("endpoint: %s is not an absolute url", raw)
+		}
+		endpoints[host] = u
+	}
+	return endpoints, nil
+}
@@ -17,10 +17,15 @@ limitations under the License.
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 
 	"github.com/acheong08/OpenAIAuth/auth"
+
+	errors2 "github.com/chatgpt-accesstoken/errors"
 )
 
 type OError struct {
@@ -48,3 +53,75 @@ func (o OError) Error() string {
 
 	return strings.Join(errs, ",")
 }
+
+// Unwrap returns the typed api error of the failed login.
+func (o OError) Unwrap() error {
+	return &errors2.Error{
+		Code:           classify(o.Err),
+		Message:        o.Error(),
+		Location:       o.Err.Location,
+		UpstreamStatus: o.Err.StatusCode,
+	}
+}
+
+// bannedDetails are found in the upstream response of a banned account.
+var bannedDetails = []string{"deactivated", "banned", "suspended"}
+
+// challengeDetails are found in a cloudflare challenge page.
+var challengeDetails = []string{"cloudflare", "just a moment", "cf-chl", "captcha"}
+
+// classify returns the error code of a failed upstream login.
+func classify(err *auth.Error) string {
+	details := strings.ToLower(err.Details)
+
+	switch code := err.StatusCode; {
+	case code == 0 && strings.HasPrefix(err.Details, "Failed to"):
+		// the request never got a response.
+		return errors2.CodeProxy
+	case code == http.StatusProxyAuthRequired:
+		return errors2.CodeProxy
+	case code == http.StatusTooManyRequests:
+		return errors2.CodeRateLimited
+	case code >= http.StatusBadRequest && code < http.StatusInternalServerError && containsAny(details, bannedDetails):
+		return errors2.CodeAccountBanned
+	case code == http.StatusForbidden, containsAny(details, challengeDetails):
+		return errors2.CodeCloudflare
+	case code >= http.StatusInternalServerError:
+		return errors2.CodeUpstream
+	case code >= http.StatusBadRequest:
+		return errors2.CodeInvalidCredentials
+	}
+	return errors2.CodeUpstream
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorCode returns the error code of a failed login.
+func errorCode(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return errors2.CodeTimeout
+	}
+
+	var apiErr *errors2.Error
+	if !errors.As(err, &apiErr) || apiErr.Code == "" {
+		return errors2.CodeUnknown
+	}
+	return apiErr.Code
+}
+
+// proxyFailure reports whether err is a login failure caused by the proxy
+// rather than by the account, such as an unreachable proxy or a blocked ip.
+func proxyFailure(err error) bool {
+	switch errorCode(err) {
+	case errors2.CodeProxy, errors2.CodeCloudflare, errors2.CodeRateLimited:
+		return true
+	}
+	return false
+}
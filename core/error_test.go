@@ -0,0 +1,58 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+
+	errors2 "github.com/chatgpt-accesstoken/errors"
+)
+
+func TestErrorCode(t *testing.T) {
+	check := errors.New("error: Check details")
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: OError{Err: auth.NewError("part_one", 0, "Failed to send request", errors.New("connection refused"))}, want: errors2.CodeProxy},
+		{err: OError{Err: auth.NewError("part_one", 407, "Proxy Authentication Required", check)}, want: errors2.CodeProxy},
+		{err: OError{Err: auth.NewError("part_one", 403, "<title>Just a moment...</title>", check)}, want: errors2.CodeCloudflare},
+		{err: OError{Err: auth.NewError("part_one", 429, "Too Many Requests", check)}, want: errors2.CodeRateLimited},
+		{err: OError{Err: auth.NewError("__part_five", 400, "Wrong email or password", check)}, want: errors2.CodeInvalidCredentials},
+		{err: OError{Err: auth.NewError("__part_five", 401, "Your account has been deactivated", check)}, want: errors2.CodeAccountBanned},
+		{err: OError{Err: auth.NewError("__part_six", 502, "502 Bad Gateway", check)}, want: errors2.CodeUpstream},
+		{err: fmt.Errorf("api: %w", context.DeadlineExceeded), want: errors2.CodeTimeout},
+		{err: errors2.ErrPasswordMismatch, want: errors2.CodePasswordMismatch},
+		{err: errors.New("boom"), want: errors2.CodeUnknown},
+	}
+	for _, tt := range tests {
+		if got := errorCode(tt.err); got != tt.want {
+			t.Errorf("Want code %s for %q, got %s", tt.want, tt.err, got)
+		}
+	}
+
+	var apiErr *errors2.Error
+	err := OError{Err: auth.NewError("__part_five", 400, "Wrong email or password", check)}
+	if !errors.As(err, &apiErr) || apiErr.Location != "__part_five" || apiErr.UpstreamStatus != 400 {
+		t.Errorf("Want typed api error, got %#v", apiErr)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+
+	akt "github.com/chatgpt-accesstoken"
+)
+
+// FakeRule scripts the logins of Email through Proxy, an empty Email or
+// Proxy matches any. A rule with a Status or Details fails the login with
+// the auth.Error of Location, Status and Details, it succeeds otherwise.
+type FakeRule struct {
+	Email string `json:"email,omitempty"`
+	Proxy string `json:"proxy,omitempty"`
+	// Times apply the rule to this many logins only, 0 to every login.
+	Times int           `json:"times,omitempty"`
+	Delay time.Duration `json:"-"`
+
+	AccessToken string        `json:"access_token,omitempty"` // AccessToken default to an unsigned jwt expiring after TTL.
+	PUID        string        `json:"puid,omitempty"`
+	TTL         time.Duration `json:"-"`
+
+	Location string `json:"location,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Details  string `json:"details,omitempty"`
+}
+
+// UnmarshalJSON decodes the durations of the rule as strings, such as "1.5s".
+func (r *FakeRule) UnmarshalJSON(data []byte) error {
+	type rule FakeRule
+	v := struct {
+		*rule
+		Delay string `json:"delay,omitempty"`
+		TTL   string `json:"ttl,omitempty"`
+	}{rule: (*rule)(r)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	var err error
+	if v.Delay != "" {
+		if r.Delay, err = time.ParseDuration(v.Delay); err != nil {
+			return err
+		}
+	}
+	if v.TTL != "" {
+		if r.TTL, err = time.ParseDuration(v.TTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *FakeRule) match(req *akt.OpenaiAuthRequest) bool {
+	return (r.Email == "" || r.Email == req.Email) && (r.Proxy == "" || r.Proxy == req.Proxy)
+}
+
+// FakeUpstream is an AuthenticatorFactory logging in without OpenAI, the
+// logins follow the first matching rule and succeed without one.
+type FakeUpstream struct {
+	lock  sync.Mutex
+	rules []*FakeRule
+	calls map[string]int
+}
+
+func NewFakeUpstream(rules ...FakeRule) *FakeUpstream {
+	f := &FakeUpstream{calls: make(map[string]int)}
+	for _, rule := range rules {
+		f.Script(rule)
+	}
+	return f
+}
+
+// LoadFakeUpstream returns a FakeUpstream following the json list of rules of filename.
+func LoadFakeUpstream(filename string) (*FakeUpstream, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []FakeRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("fake: cannot parse %s: %s", filename, err)
+	}
+	return NewFakeUpstream(rules...), nil
+}
+
+// Script appends rule to the rules.
+func (f *FakeUpstream) Script(rule FakeRule) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rules = append(f.rules, &rule)
+}
+
+// Calls returns the number of logins of email.
+func (f *FakeUpstream) Calls(email string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[email]
+}
+
+func (f *FakeUpstream) New(req *akt.OpenaiAuthRequest) akt.Authenticator {
+	return &fakeAuthenticator{upstream: f, req: req}
+}
+
+// rule returns the rule of a login of req, nil to succeed.
+func (f *FakeUpstream) rule(req *akt.OpenaiAuthRequest) *FakeRule {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.calls[req.Email]++
+	for i, rule := range f.rules {
+		if !rule.match(req) {
+			continue
+		}
+		if rule.Times > 0 {
+			if rule.Times--; rule.Times == 0 {
+				f.rules = append(f.rules[:i:i], f.rules[i+1:]...)
+			}
+		}
+		return rule
+	}
+	return nil
+}
+
+type fakeAuthenticator struct {
+	upstream *FakeUpstream
+	req      *akt.OpenaiAuthRequest
+}
+
+func (a *fakeAuthenticator) Login(ctx context.Context) (*auth.AuthResult, error) {
+	rule := a.upstream.rule(a.req)
+	if rule == nil {
+		rule = new(FakeRule)
+	}
+	profile := a.req.ClientProfile
+	if profile == "" {
+		profile = "fake"
+	}
+	reportProfile(ctx, profile)
+
+	if err := rule.wait(ctx); err != nil {
+		return nil, err
+	}
+	if rule.Status != 0 || rule.Details != "" {
+		return nil, OError{Err: auth.NewError(rule.Location, rule.Status, rule.Details, errors.New(rule.Details))}
+	}
+
+	res := &auth.AuthResult{
+		AccessToken:  rule.AccessToken,
+		RefreshToken: "fake-refresh-token",
+		PUID:         rule.PUID,
+	}
+	if res.AccessToken == "" {
+		ttl := rule.TTL
+		if ttl == 0 {
+			ttl = 24 * time.Hour
+		}
+		res.AccessToken = fakeToken(a.req.Email, time.Now().Add(ttl))
+	}
+	if res.PUID == "" {
+		res.PUID = "user-fake"
+	}
+	return res, nil
+}
+
+func (a *fakeAuthenticator) PUID(ctx context.Context) (string, error) {
+	res, err := a.Login(ctx)
+	if err != nil {
+		return "", err
+	}
+	return res.PUID, nil
+}
+
+func (r *FakeRule) wait(ctx context.Context) error {
+	if r.Delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(r.Delay):
+		return nil
+	}
+}
+
+// fakeToken returns an unsigned jwt of email expiring at exp.
+func fakeToken(email string, exp time.Time) string {
+	claims, _ := json.Marshal(map[string]interface{}{
+		"email": email,
+		"exp":   exp.Unix(),
+		"fake":  true,
+	})
+	return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(claims) + ".fake"
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/workpieces/log"
+
+	akt "github.com/chatgpt-accesstoken"
+	errors2 "github.com/chatgpt-accesstoken/errors"
+)
+
+func TestFakeUpstream(t *testing.T) {
+	ctx := context.Background()
+	broken, working := "http://a:b@127.0.0.1:1", "http://a:b@127.0.0.1:2"
+
+	proxySvc := NewProxyLocalService()
+	for _, proxy := range []string{broken, working} {
+		if err := proxySvc.Add(ctx, proxy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upstream := NewFakeUpstream(
+		FakeRule{Email: "banned@b.c", Location: "__part_five", Status: 403, Details: "Your account has been deactivated"},
+		FakeRule{Email: "slow@b.c", Delay: time.Second},
+		FakeRule{Proxy: broken, Details: "Failed to send request"},
+	)
+	svc := NewOpenaiAuthCache(proxySvc, New(WithAuthenticator(upstream), WithLoginTimeout(50*time.Millisecond)),
+		NewAccessTokenStore(), log.NewNop(), WithRetry(2, 0))
+
+	c, trace := akt.WithLoginTrace(ctx)
+	res, err := svc.AccessToken(c, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokenExpires(res.AccessToken); err != nil {
+		t.Errorf("Want a jwt access token, got error %s", err)
+	}
+	if got := trace.Proxies(); len(got) == 0 || got[len(got)-1] != akt.ProxyID(working) {
+		t.Errorf("Want the login to end on the working proxy, tried %v", got)
+	}
+
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{email: "banned@b.c", want: errors2.CodeAccountBanned},
+		{email: "slow@b.c", want: errors2.CodeTimeout},
+	}
+	for _, tt := range tests {
+		_, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: tt.email, Password: "secret", Proxy: working})
+		if got := errorCode(err); got != tt.want {
+			t.Errorf("Want error code %s logging %s in, got %s", tt.want, tt.email, got)
+		}
+	}
+	if got, want := upstream.Calls("banned@b.c"), 1; got != want {
+		t.Errorf("Want %d login of the banned account, got %d", want, got)
+	}
+}
+
+func TestLoadFakeUpstream(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "fake.json")
+	script := `[{"email": "a@b.c", "times": 1, "delay": "1ms", "status": 429, "details": "Too many requests"}]`
+	if err := os.WriteFile(filename, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream, err := LoadFakeUpstream(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &akt.OpenaiAuthRequest{Email: "a@b.c"}
+	if _, err := upstream.New(req).Login(context.Background()); errorCode(err) != errors2.CodeRateLimited {
+		t.Errorf("Want rate limited, got %v", err)
+	}
+	if _, err := upstream.New(req).Login(context.Background()); err != nil {
+		t.Errorf("Want the rule applied once, got error %s", err)
+	}
+}
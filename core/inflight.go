@@ -0,0 +1,77 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"sync"
+
+	"github.com/chatgpt-accesstoken/errors"
+)
+
+// Inflight tracks the upstream logins still running, no login starts
+// anymore once Wait drains them.
+type Inflight struct {
+	lock    sync.Mutex
+	running int
+	closed  bool
+	idle    chan struct{}
+}
+
+func NewInflight() *Inflight {
+	return &Inflight{idle: make(chan struct{})}
+}
+
+// add counts a login starting, it fails with errors.ErrShuttingDown while draining.
+func (i *Inflight) add() error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.closed {
+		return errors.ErrShuttingDown
+	}
+	i.running++
+	return nil
+}
+
+func (i *Inflight) done() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.running--
+	if i.closed && i.running == 0 {
+		close(i.idle)
+	}
+}
+
+// Wait refuses the new logins and waits for the running ones to finish or
+// ctx to be done.
+func (i *Inflight) Wait(ctx context.Context) error {
+	i.lock.Lock()
+	if !i.closed {
+		i.closed = true
+		if i.running == 0 {
+			close(i.idle)
+		}
+	}
+	i.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-i.idle:
+		return nil
+	}
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+	"github.com/workpieces/log"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+)
+
+type jobService struct {
+	store akt.JobStore
+	stale time.Duration
+}
+
+// NewJobService returns a JobService reporting a job failed once it has been
+// running for longer than stale, its runner is gone, 0 never does.
+func NewJobService(store akt.JobStore, stale time.Duration) akt.JobService {
+	return &jobService{store: store, stale: stale}
+}
+
+func (s *jobService) Create(ctx context.Context, job *akt.Job) error {
+	job.ID = newID()
+	job.Status = akt.JobPending
+	job.Created = time.Now()
+	job.Updated = job.Created
+	if job.Request != nil {
+		job.Email = job.Request.Email
+	}
+	return s.store.Push(ctx, job)
+}
+
+func (s *jobService) Get(ctx context.Context, id string) (*akt.Job, error) {
+	job, err := s.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.stale > 0 && job.Status == akt.JobRunning && time.Since(job.Updated) > s.stale {
+		job.Status = akt.JobFailed
+		job.Request = nil
+		job.Code = errors.CodeTimeout
+		job.Error = fmt.Sprintf("job: abandoned by its runner after %s", s.stale)
+		job.Updated = time.Now()
+		ok, err := s.store.Update(ctx, job, akt.JobRunning)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// the runner was not gone after all.
+			return s.store.Get(ctx, id)
+		}
+	}
+	return job, nil
+}
+
+// Cancel cancels the job unless it is done, a job moving on meanwhile is
+// looked at again.
+func (s *jobService) Cancel(ctx context.Context, id string) error {
+	for {
+		job, err := s.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if done(job) {
+			return errors.NewCode(errors.CodeInvalidRequest, fmt.Sprintf("job: %s is already %s", id, job.Status))
+		}
+
+		from := job.Status
+		job.Status = akt.JobCancelled
+		job.Request = nil
+		job.Updated = time.Now()
+		ok, err := s.store.Update(ctx, job, from)
+		if err != nil || ok {
+			return err
+		}
+	}
+}
+
+// done reports whether job will not run anymore.
+func done(job *akt.Job) bool {
+	switch job.Status {
+	case akt.JobSucceeded, akt.JobFailed, akt.JobCancelled:
+		return true
+	}
+	return false
+}
+
+// JobRunner runs the queued login jobs, the running jobs are cancelled
+// within poll once cancelled from any replica.
+type JobRunner struct {
+	store      akt.JobStore
+	svc        akt.OpenaiAuthService
+	accountSvc akt.AccountService
+	logger     log.Logger
+	workers    int
+	poll       time.Duration
+
+	cancel context.CancelFunc
+	jobs   context.Context
+	abort  context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewJobRunner(store akt.JobStore, svc akt.OpenaiAuthService, accountSvc akt.AccountService, logger log.Logger, workers int) *JobRunner {
+	return &JobRunner{
+		store:      store,
+		svc:        svc,
+		accountSvc: accountSvc,
+		logger:     logger.WithField("job", "runner"),
+		workers:    workers,
+		poll:       time.Second,
+	}
+}
+
+// Start runs the jobs until ctx is done or Close. The running jobs do not
+// depend on ctx, they are left to finish by Close.
+func (r *JobRunner) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.jobs, r.abort = context.WithCancel(context.Background())
+
+	for i := 0; i < r.workers; i++ {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			for ctx.Err() == nil {
+				job, err := r.store.Pop(ctx, r.poll)
+				if err != nil {
+					if ctx.Err() == nil {
+						r.logger.Error(fmt.Sprintf("job: cannot pop job: %s", err))
+						time.Sleep(r.poll)
+					}
+					continue
+				}
+				if job != nil {
+					r.run(r.jobs, job)
+				}
+			}
+		}()
+	}
+}
+
+// Close stops taking jobs and waits for the running ones until ctx is
+// done, the jobs still running then are aborted and queued again for
+// another replica.
+func (r *JobRunner) Close(ctx context.Context) error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		r.abort()
+		<-done
+		return ctx.Err()
+	case <-done:
+		r.abort()
+		return nil
+	}
+}
+
+func (r *JobRunner) run(ctx context.Context, job *akt.Job) {
+	if job.Status != akt.JobPending {
+		// cancelled while queued.
+		return
+	}
+	jlog := r.logger.WithField("id", job.ID)
+
+	job.Status = akt.JobRunning
+	job.Updated = time.Now()
+	if ok, err := r.store.Update(ctx, job, akt.JobPending); err != nil || !ok {
+		if err != nil {
+			jlog.Error(fmt.Sprintf("job: cannot save job: %s", err))
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go r.watch(ctx, job.ID, cancel)
+
+	c, trace := akt.WithLoginTrace(ctx)
+	res, err := r.login(c, job)
+
+	if r.jobs.Err() != nil {
+		job.Status = akt.JobPending
+		job.Updated = time.Now()
+		ok, err := r.store.Requeue(context.Background(), job, akt.JobRunning)
+		if err != nil {
+			jlog.Error(fmt.Sprintf("job: cannot queue job again: %s", err))
+			return
+		}
+		if ok {
+			jlog.Info("job: aborted on shutdown, queued again")
+		}
+		return
+	}
+
+	job.Request = nil
+	job.ProxyTried = trace.Proxies()
+	job.Updated = time.Now()
+	if err != nil {
+		job.Status = akt.JobFailed
+		job.Code = errorCode(err)
+		job.Error = err.Error()
+	} else {
+		job.Status = akt.JobSucceeded
+		job.Result = res
+	}
+	// a job cancelled meanwhile stays cancelled.
+	ok, err := r.store.Update(context.Background(), job, akt.JobRunning)
+	if err != nil {
+		jlog.Error(fmt.Sprintf("job: cannot save job: %s", err))
+		return
+	}
+	if !ok {
+		jlog.Info("job: cancelled")
+	}
+}
+
+func (r *JobRunner) login(ctx context.Context, job *akt.Job) (*auth.AuthResult, error) {
+	req := job.Request
+	if job.AccountID != "" {
+		account, err := r.accountSvc.Get(ctx, job.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		job.Email = account.Email
+		req = account.AuthRequest()
+	}
+	if req == nil {
+		return nil, errors.NewCode(errors.CodeInvalidRequest, "job: cannot find the login request")
+	}
+
+	return r.svc.AccessToken(ctx, req)
+}
+
+// watch cancels the running job id once it is cancelled.
+func (r *JobRunner) watch(ctx context.Context, id string, cancel context.CancelFunc) {
+	ticker := time.NewTicker(r.poll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if job, err := r.store.Get(ctx, id); err == nil && job.Status == akt.JobCancelled {
+				cancel()
+				return
+			}
+		}
+	}
+}
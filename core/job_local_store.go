@@ -0,0 +1,142 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+)
+
+type jobLocalStore struct {
+	db    map[string]*akt.Job
+	queue chan string
+	ttl   time.Duration
+	lock  sync.RWMutex
+}
+
+// NewJobLocalStore returns a JobStore queueing at most size jobs, the jobs
+// are forgotten ttl after their last update.
+func NewJobLocalStore(size int, ttl time.Duration) akt.JobStore {
+	return &jobLocalStore{
+		db:    make(map[string]*akt.Job),
+		queue: make(chan string, size),
+		ttl:   ttl,
+	}
+}
+
+func (s *jobLocalStore) Push(ctx context.Context, job *akt.Job) error {
+	if err := s.Save(ctx, job); err != nil {
+		return err
+	}
+
+	select {
+	case s.queue <- job.ID:
+		return nil
+	default:
+		s.lock.Lock()
+		delete(s.db, job.ID)
+		s.lock.Unlock()
+		return fmt.Errorf("job: queue is full")
+	}
+}
+
+func (s *jobLocalStore) Pop(ctx context.Context, timeout time.Duration) (*akt.Job, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, nil
+	case id := <-s.queue:
+		job, err := s.Get(ctx, id)
+		if err == errors.ErrNotFound {
+			return nil, nil
+		}
+		return job, err
+	}
+}
+
+func (s *jobLocalStore) Save(ctx context.Context, job *akt.Job) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, v := range s.db {
+		if time.Since(v.Updated) > s.ttl {
+			delete(s.db, id)
+		}
+	}
+
+	v := *job
+	s.db[job.ID] = &v
+	return nil
+}
+
+func (s *jobLocalStore) Update(ctx context.Context, job *akt.Job, from string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if v, ok := s.db[job.ID]; !ok || v.Status != from {
+		return false, nil
+	}
+	v := *job
+	s.db[job.ID] = &v
+	return true, nil
+}
+
+func (s *jobLocalStore) Requeue(ctx context.Context, job *akt.Job, from string) (bool, error) {
+	ok, err := s.Update(ctx, job, from)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	select {
+	case s.queue <- job.ID:
+		return true, nil
+	default:
+		return true, fmt.Errorf("job: queue is full")
+	}
+}
+
+func (s *jobLocalStore) Get(ctx context.Context, id string) (*akt.Job, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	job, ok := s.db[id]
+	if !ok {
+		return nil, errors.ErrNotFound
+	}
+	v := *job
+	return &v, nil
+}
+
+func (s *jobLocalStore) List(ctx context.Context) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	list := make([]string, 0, len(s.db))
+	for id := range s.db {
+		list = append(list, id)
+	}
+	return list, nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+	"github.com/chatgpt-accesstoken/store/redisdb"
+)
+
+const (
+	// jobKey is the redis key prefix of the jobs.
+	jobKey = "akt:job:"
+	// jobQueueKey is the redis list of the queued job ids.
+	jobQueueKey = "akt:jobs"
+)
+
+type jobRedisStore struct {
+	db  *redisdb.Redis
+	ttl time.Duration
+}
+
+// NewJobRedisStore returns a JobStore shared by all replicas, the jobs are
+// removed by redis ttl after their last update.
+func NewJobRedisStore(db *redisdb.Redis, ttl time.Duration) akt.JobStore {
+	return &jobRedisStore{db: db, ttl: ttl}
+}
+
+func (s *jobRedisStore) Push(ctx context.Context, job *akt.Job) error {
+	if err := s.Save(ctx, job); err != nil {
+		return err
+	}
+	return s.db.LPush(jobQueueKey, job.ID)
+}
+
+func (s *jobRedisStore) Pop(ctx context.Context, timeout time.Duration) (*akt.Job, error) {
+	res, err := s.db.BRPop(timeout, jobQueueKey)
+	if err != nil || len(res) != 2 {
+		return nil, err
+	}
+
+	job, err := s.Get(ctx, res[1])
+	if err == errors.ErrNotFound {
+		// expired while queued.
+		return nil, nil
+	}
+	return job, err
+}
+
+func (s *jobRedisStore) Save(ctx context.Context, job *akt.Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.db.Set(jobKey+job.ID, string(data), s.ttl)
+}
+
+func (s *jobRedisStore) Update(ctx context.Context, job *akt.Job, from string) (bool, error) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return false, err
+	}
+	return s.db.SetIfField(jobKey+job.ID, "status", from, string(data), s.ttl)
+}
+
+func (s *jobRedisStore) Requeue(ctx context.Context, job *akt.Job, from string) (bool, error) {
+	ok, err := s.Update(ctx, job, from)
+	if err != nil || !ok {
+		return ok, err
+	}
+	// a job cancelled once updated is skipped by the runner popping it.
+	return true, s.db.LPush(jobQueueKey, job.ID)
+}
+
+func (s *jobRedisStore) Get(ctx context.Context, id string) (*akt.Job, error) {
+	v := s.db.Get(jobKey + id)
+	if v == "" {
+		return nil, errors.ErrNotFound
+	}
+
+	job := new(akt.Job)
+	if err := json.Unmarshal([]byte(v), job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *jobRedisStore) List(ctx context.Context) ([]string, error) {
+	keys, err := s.db.Scan(jobKey + "*")
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, strings.TrimPrefix(key, jobKey))
+	}
+	return list, nil
+}
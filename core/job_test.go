@@ -0,0 +1,267 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/workpieces/log"
+
+	akt "github.com/chatgpt-accesstoken"
+)
+
+func TestJobRunner(t *testing.T) {
+	tests := []struct {
+		name  string
+		store func(t *testing.T) akt.JobStore
+	}{
+		{
+			name:  "local",
+			store: func(t *testing.T) akt.JobStore { return NewJobLocalStore(10, time.Hour) },
+		},
+		{
+			name: "redis",
+			store: func(t *testing.T) akt.JobStore {
+				db, _ := newTestRedis(t)
+				return NewJobRedisStore(db, time.Hour)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testJobRunner(t, tt.store(t))
+		})
+	}
+}
+
+func testJobRunner(t *testing.T, store akt.JobStore) {
+	ctx := context.Background()
+	upstream := &countingAuthService{delay: 300 * time.Millisecond}
+	accountSvc := NewAccountLocalService()
+	svc := NewOpenaiAuthCache(newTestProxyService(t), upstream, NewAccessTokenStore(), log.NewNop())
+	jobSvc := NewJobService(store, time.Minute)
+
+	// wait polls the job until it is done.
+	wait := func(id string) *akt.Job {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			job, err := jobSvc.Get(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done(job) {
+				return job
+			}
+		}
+		t.Fatalf("Want job %s done", id)
+		return nil
+	}
+
+	// a job cancelled while queued never runs.
+	queued := &akt.Job{Request: &akt.OpenaiAuthRequest{Email: "g@h.i", Password: "secret"}}
+	if err := jobSvc.Create(ctx, queued); err != nil {
+		t.Fatal(err)
+	}
+	if err := jobSvc.Cancel(ctx, queued.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := NewJobRunner(store, svc, accountSvc, log.NewNop(), 2)
+	runner.poll = 50 * time.Millisecond
+	runner.Start(ctx)
+	defer runner.Close(ctx)
+
+	job := &akt.Job{Request: &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"}}
+	if err := jobSvc.Create(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != akt.JobPending {
+		t.Errorf("Want job pending, got %s", job.Status)
+	}
+	if got := wait(job.ID); got.Status != akt.JobSucceeded || got.Result.AccessToken != "token-a@b.c" || got.Request != nil {
+		t.Errorf("Want job succeeded without its credentials, got %+v", got)
+	}
+
+	account := &akt.Account{Email: "d@e.f", Password: "secret"}
+	accountSvc.Create(ctx, account)
+	byID := &akt.Job{AccountID: account.ID}
+	jobSvc.Create(ctx, byID)
+	if got := wait(byID.ID); got.Status != akt.JobSucceeded || got.Email != "d@e.f" {
+		t.Errorf("Want account job succeeded, got %+v", got)
+	}
+
+	unknown := &akt.Job{AccountID: "unknown"}
+	jobSvc.Create(ctx, unknown)
+	if got := wait(unknown.ID); got.Status != akt.JobFailed || got.Code != "not_found" {
+		t.Errorf("Want job of an unknown account failed, got %+v", got)
+	}
+
+	running := &akt.Job{Request: &akt.OpenaiAuthRequest{Email: "j@k.l", Password: "secret"}}
+	jobSvc.Create(ctx, running)
+	time.Sleep(100 * time.Millisecond)
+	if err := jobSvc.Cancel(ctx, running.ID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if got, _ := jobSvc.Get(ctx, running.ID); got.Status != akt.JobCancelled {
+		t.Errorf("Want running job cancelled, got %s", got.Status)
+	}
+
+	if got, _ := jobSvc.Get(ctx, queued.ID); got.Status != akt.JobCancelled {
+		t.Errorf("Want queued job cancelled, got %s", got.Status)
+	}
+	if err := jobSvc.Cancel(ctx, job.ID); err == nil {
+		t.Errorf("Want error cancelling a done job")
+	}
+}
+
+func TestJobRunnerClose(t *testing.T) {
+	ctx := context.Background()
+	store := NewJobLocalStore(10, time.Hour)
+	upstream := &countingAuthService{delay: 200 * time.Millisecond}
+	svc := NewOpenaiAuthCache(newTestProxyService(t), upstream, NewAccessTokenStore(), log.NewNop())
+	jobSvc := NewJobService(store, time.Minute)
+
+	start := func() *JobRunner {
+		runner := NewJobRunner(store, svc, NewAccountLocalService(), log.NewNop(), 1)
+		runner.poll = 20 * time.Millisecond
+		runner.Start(ctx)
+		return runner
+	}
+
+	// the running job drains on shutdown.
+	runner := start()
+	drained := &akt.Job{Request: &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"}}
+	jobSvc.Create(ctx, drained)
+	time.Sleep(50 * time.Millisecond)
+	if err := runner.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := jobSvc.Get(ctx, drained.ID); got.Status != akt.JobSucceeded {
+		t.Errorf("Want running job drained, got %s", got.Status)
+	}
+
+	// the job still running once the drain is over is queued again.
+	runner = start()
+	aborted := &akt.Job{Request: &akt.OpenaiAuthRequest{Email: "d@e.f", Password: "secret"}}
+	jobSvc.Create(ctx, aborted)
+	time.Sleep(50 * time.Millisecond)
+	c, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := runner.Close(c); err == nil {
+		t.Errorf("Want error of the drain deadline")
+	}
+	if got, _ := jobSvc.Get(ctx, aborted.ID); got.Status != akt.JobPending || got.Request == nil {
+		t.Errorf("Want aborted job queued again with its request, got %+v", got)
+	}
+
+	runner = start()
+	defer runner.Close(ctx)
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if got, _ := jobSvc.Get(ctx, aborted.ID); got.Status == akt.JobSucceeded {
+			return
+		}
+	}
+	t.Errorf("Want job queued again run by the next runner")
+}
+
+func TestJobServiceStale(t *testing.T) {
+	ctx := context.Background()
+	store := NewJobLocalStore(10, time.Hour)
+	jobSvc := NewJobService(store, time.Minute)
+
+	// the replica running the job is gone.
+	job := &akt.Job{ID: "j1", Status: akt.JobRunning, Request: &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"}, Updated: time.Now().Add(-2 * time.Minute)}
+	store.Save(ctx, job)
+
+	got, err := jobSvc.Get(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != akt.JobFailed || got.Code != "timeout" || got.Request != nil {
+		t.Errorf("Want stale job failed without its credentials, got %+v", got)
+	}
+}
+
+// cancellingStore cancels each job right before the runner saves it done.
+type cancellingStore struct {
+	akt.JobStore
+	jobSvc akt.JobService
+}
+
+func (s *cancellingStore) Update(ctx context.Context, job *akt.Job, from string) (bool, error) {
+	if done(job) {
+		if err := s.jobSvc.Cancel(ctx, job.ID); err != nil {
+			return false, err
+		}
+	}
+	return s.JobStore.Update(ctx, job, from)
+}
+
+func TestJobRunnerCancelRace(t *testing.T) {
+	tests := []struct {
+		name  string
+		store func(t *testing.T) akt.JobStore
+	}{
+		{
+			name:  "local",
+			store: func(t *testing.T) akt.JobStore { return NewJobLocalStore(10, time.Hour) },
+		},
+		{
+			name: "redis",
+			store: func(t *testing.T) akt.JobStore {
+				db, _ := newTestRedis(t)
+				return NewJobRedisStore(db, time.Hour)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := tt.store(t)
+			jobSvc := NewJobService(store, time.Minute)
+			svc := NewOpenaiAuthCache(newTestProxyService(t), new(countingAuthService), NewAccessTokenStore(), log.NewNop())
+			runner := NewJobRunner(&cancellingStore{JobStore: store, jobSvc: jobSvc}, svc, NewAccountLocalService(), log.NewNop(), 1)
+			runner.jobs = ctx
+
+			// the cancel lands while the login ends.
+			job := &akt.Job{Request: &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"}}
+			if err := jobSvc.Create(ctx, job); err != nil {
+				t.Fatal(err)
+			}
+			runner.run(ctx, job)
+			if got, _ := jobSvc.Get(ctx, job.ID); got.Status != akt.JobCancelled || got.Result != nil {
+				t.Errorf("Want job cancelled during its run, got %+v", got)
+			}
+
+			// the cancel lands while the job is taken.
+			queued := &akt.Job{Request: &akt.OpenaiAuthRequest{Email: "d@e.f", Password: "secret"}}
+			if err := jobSvc.Create(ctx, queued); err != nil {
+				t.Fatal(err)
+			}
+			if err := jobSvc.Cancel(ctx, queued.ID); err != nil {
+				t.Fatal(err)
+			}
+			runner.run(ctx, queued)
+			if got, _ := jobSvc.Get(ctx, queued.ID); got.Status != akt.JobCancelled {
+				t.Errorf("Want job cancelled before its run, got %s", got.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestTokenExpires(t *testing.T) {
+	enc := base64.RawURLEncoding.EncodeToString
+	tests := []struct {
+		name    string
+		token   string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:  "exp claim",
+			token: enc([]byte(`{"alg":"RS256"}`)) + "." + enc([]byte(`{"exp":1700000000}`)) + ".sig",
+			want:  time.Unix(1700000000, 0),
+		},
+		{
+			name:    "missing exp claim",
+			token:   enc([]byte(`{"alg":"RS256"}`)) + "." + enc([]byte(`{"sub":"me"}`)) + ".sig",
+			wantErr: true,
+		},
+		{
+			name:    "not a jwt",
+			token:   "sk-opaque",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tokenExpires(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Want error %v, got %v", tt.wantErr, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("Want expires %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/store/redisdb"
+)
+
+// lockKey is the redis key prefix of the locks shared by the replicas.
+const lockKey = "akt:lock:"
+
+type locker struct {
+	db *redisdb.Redis
+}
+
+// NewLocker returns a Locker shared by all replicas using the same redis.
+func NewLocker(db *redisdb.Redis) akt.Locker {
+	return &locker{db: db}
+}
+
+func (l *locker) Lock(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	token := newID()
+	ok, err := l.db.LockNx(lockKey+key, token, ttl)
+	if err != nil || !ok {
+		return "", err
+	}
+	return token, nil
+}
+
+func (l *locker) Unlock(ctx context.Context, key, token string) error {
+	return l.db.UnLockNx(lockKey+key, token)
+}
+
+func (l *locker) Extend(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	return l.db.ExtendNx(lockKey+key, token, ttl)
+}
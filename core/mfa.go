@@ -0,0 +1,113 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+
+	"github.com/chatgpt-accesstoken/errors"
+)
+
+// mfaChallengePath is where auth0 redirects the login of an account with
+// two-factor enabled.
+const mfaChallengePath = "/u/mfa-otp-challenge"
+
+// mfaSession answers the one-time code challenge of the login with the
+// TOTP code of secret, the upstream login library does not know about it.
+// auth0 asks for the code when the login resumes after the password, so
+// the answered challenge is followed back to the end of the resume, which
+// redirects to the callback carrying the authorization code.
+type mfaSession struct {
+	tls_client.HttpClient
+	secret string
+	// err why the challenge failed, the library only sees an unexpected response.
+	err error
+}
+
+func (s *mfaSession) Do(req *http.Request) (*http.Response, error) {
+	resp, err := s.HttpClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusFound {
+		return resp, err
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(location.Path, mfaChallengePath) {
+		return resp, nil
+	}
+	if s.secret == "" {
+		s.err = errors.ErrMFARequired
+		return resp, nil
+	}
+
+	code, err := TOTP(s.secret, time.Now())
+	if err != nil {
+		s.err = errors.NewCode(errors.CodeInvalidRequest, err.Error())
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	state := location.Query().Get("state")
+	challenge := req.URL.Scheme + "://" + req.URL.Host + mfaChallengePath + "?state=" + url.QueryEscape(state)
+	form := url.Values{
+		"state":  {state},
+		"code":   {code},
+		"action": {"default"},
+	}
+
+	r, err := http.NewRequest(http.MethodPost, challenge, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(req.Context())
+	r.Header.Set("User-Agent", req.Header.Get("User-Agent"))
+	r.Header.Set("Origin", req.URL.Scheme+"://"+req.URL.Host)
+	r.Header.Set("Referer", challenge)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err = s.HttpClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusFound {
+		s.err = errors.ErrMFARejected
+		return resp, nil
+	}
+	return s.resume(r, resp)
+}
+
+// resume follows the redirect of the answered challenge resp back to the login.
+func (s *mfaSession) resume(challenge *http.Request, resp *http.Response) (*http.Response, error) {
+	location, err := challenge.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	r, err := http.NewRequest(http.MethodGet, location.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(challenge.Context())
+	r.Header.Set("User-Agent", challenge.Header.Get("User-Agent"))
+	r.Header.Set("Referer", challenge.URL.String())
+	return s.HttpClient.Do(r)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	tls_client "github.com/bogdanfinn/tls-client"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+)
+
+// defaultClientProfile is the profile of the upstream login library.
+const defaultClientProfile = "firefox_102"
+
+// ClientProfile is the fingerprint of the upstream requests of a login.
+type ClientProfile struct {
+	Name      string `json:"client_profile,omitempty"` // Name tls-client profile, see tls_client.MappedTLSClients.
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// validClientProfile returns an error if name is not a tls-client profile.
+func validClientProfile(name string) error {
+	if _, ok := tls_client.MappedTLSClients[name]; !ok {
+		return errors.NewCode(errors.CodeInvalidRequest, fmt.Sprintf("profile: unknown client profile %s", name))
+	}
+	return nil
+}
+
+// LoadProxyProfiles returns the profiles of the json object of filename,
+// keyed by the proxy address or its id, see WithProxyProfiles.
+func LoadProxyProfiles(filename string) (map[string]ClientProfile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var proxies map[string]ClientProfile
+	if err := json.Unmarshal(data, &proxies); err != nil {
+		return nil, fmt.Errorf("profile: cannot parse %s: %s", filename, err)
+	}
+	return proxies, nil
+}
+
+// clientProfile returns the profile of req, each field defaults to the one
+// of the proxy of req in proxies, then to the one of fallback.
+func clientProfile(req *akt.OpenaiAuthRequest, proxies map[string]ClientProfile, fallback ClientProfile) ClientProfile {
+	p := ClientProfile{Name: req.ClientProfile, UserAgent: req.UserAgent}
+
+	candidates := []ClientProfile{fallback, {Name: defaultClientProfile}}
+	if req.Proxy != "" {
+		if v, ok := proxies[req.Proxy]; ok {
+			candidates = append([]ClientProfile{v}, candidates...)
+		} else if v, ok := proxies[akt.ProxyID(req.Proxy)]; ok {
+			candidates = append([]ClientProfile{v}, candidates...)
+		}
+	}
+
+	for _, c := range candidates {
+		if p.Name == "" {
+			p.Name = c.Name
+		}
+		if p.UserAgent == "" {
+			p.UserAgent = c.UserAgent
+		}
+	}
+	return p
+}
+
+// newSession returns the session of the upstream login library with the
+// tls-client profile name. tls-client already resolves the hosts through
+// socks5 proxies, it only lacks the socks5h scheme.
+func newSession(name, proxy string) (tls_client.HttpClient, error) {
+	if strings.HasPrefix(proxy, "socks5h://") {
+		proxy = "socks5://" + strings.TrimPrefix(proxy, "socks5h://")
+	}
+	return tls_client.NewHttpClient(tls_client.NewNoopLogger(),
+		tls_client.WithTimeoutSeconds(20),
+		tls_client.WithClientProfile(tls_client.MappedTLSClients[name]),
+		tls_client.WithNotFollowRedirects(),
+		tls_client.WithCookieJar(tls_client.NewCookieJar()),
+		tls_client.WithProxyUrl(proxy),
+	)
+}
+
+type profileKey struct{}
+
+// profileReport is the client profile of a login, reported by its authenticator.
+type profileReport struct {
+	lock sync.Mutex
+	name string
+}
+
+// withProfileReport returns a ctx the authenticator reports the client profile of the login into.
+func withProfileReport(ctx context.Context) (context.Context, *profileReport) {
+	r := new(profileReport)
+	return context.WithValue(ctx, profileKey{}, r), r
+}
+
+// reportProfile reports the client profile name of the login of ctx.
+func reportProfile(ctx context.Context, name string) {
+	if r, ok := ctx.Value(profileKey{}).(*profileReport); ok {
+		r.lock.Lock()
+		r.name = name
+		r.lock.Unlock()
+	}
+}
+
+// Name returns the client profile reported.
+func (r *profileReport) Name() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.name
+}
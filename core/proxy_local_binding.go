@@ -0,0 +1,66 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"sync"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+)
+
+type proxyLocalBindingService struct {
+	db   map[string]string
+	lock sync.RWMutex
+}
+
+func NewProxyLocalBindingService() akt.ProxyBindingService {
+	return &proxyLocalBindingService{
+		db: make(map[string]string),
+	}
+}
+
+func (s *proxyLocalBindingService) Get(ctx context.Context, email string) (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	proxy, ok := s.db[email]
+	if !ok {
+		return "", errors.ErrNotFound
+	}
+	return proxy, nil
+}
+
+func (s *proxyLocalBindingService) Bind(ctx context.Context, email, proxy string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.db[email] = proxy
+	return nil
+}
+
+func (s *proxyLocalBindingService) Unbind(ctx context.Context, email string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.db[email]; !ok {
+		return errors.ErrNotFound
+	}
+	delete(s.db, email)
+	return nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+)
+
+type proxyLocalCooldown struct {
+	db   map[string]time.Time
+	lock sync.Mutex
+}
+
+func NewProxyLocalCooldown() akt.ProxyCooldown {
+	return &proxyLocalCooldown{
+		db: make(map[string]time.Time),
+	}
+}
+
+func (c *proxyLocalCooldown) Acquire(ctx context.Context, proxy string, ttl time.Duration) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if until, ok := c.db[proxy]; ok && time.Now().Before(until) {
+		return false, nil
+	}
+	c.db[proxy] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (c *proxyLocalCooldown) Release(ctx context.Context, proxy string, d time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if d <= 0 {
+		delete(c.db, proxy)
+		return nil
+	}
+	c.db[proxy] = time.Now().Add(d)
+	return nil
+}
@@ -19,8 +19,10 @@ package core
 import (
 	"context"
 	"fmt"
-	akt "github.com/chatgpt-accesstoken"
 	"sync"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
 )
 
 type proxyLocalService struct {
@@ -49,21 +51,35 @@ func (s *proxyLocalService) List(ctx context.Context) ([]string, error) {
 }
 
 func (s *proxyLocalService) Add(ctx context.Context, ip string) error {
+	ip, err := akt.ParseProxy(ip)
+	if err != nil {
+		return err
+	}
+
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	if s.db[ip] {
+		return errors.NewCode(errors.CodeInvalidRequest, fmt.Sprintf("local: %s already exists", akt.ProxyRedacted(ip)))
+	}
 	s.db[ip] = true
 	return nil
 }
 
 func (s *proxyLocalService) Delete(ctx context.Context, ip string) error {
+	candidates := []string{ip}
+	if v, err := akt.ParseProxy(ip); err == nil && v != ip {
+		candidates = []string{v, ip}
+	}
+
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	_, ok := s.db[ip]
-	if ok {
-		delete(s.db, ip)
-		return nil
+	for _, proxy := range candidates {
+		if s.db[proxy] {
+			delete(s.db, proxy)
+			return nil
+		}
 	}
-	return fmt.Errorf("local: %s don't exist", ip)
+	return fmt.Errorf("local: %s don't exist", akt.ProxyRedacted(ip))
 }
@@ -0,0 +1,60 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+)
+
+type proxyLocalQuarantine struct {
+	db   map[string]time.Time
+	lock sync.Mutex
+}
+
+func NewProxyLocalQuarantine() akt.ProxyQuarantine {
+	return &proxyLocalQuarantine{
+		db: make(map[string]time.Time),
+	}
+}
+
+func (q *proxyLocalQuarantine) Quarantine(ctx context.Context, proxy string, ttl time.Duration) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.db[proxy] = time.Now().Add(ttl)
+	return nil
+}
+
+func (q *proxyLocalQuarantine) Quarantined(ctx context.Context, proxy string) (bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	until, ok := q.db[proxy]
+	if !ok {
+		return false, nil
+	}
+
+	if time.Now().After(until) {
+		delete(q.db, proxy)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+)
+
+type proxyLocalStats struct {
+	stats   akt.ProxyStats
+	latency time.Duration
+}
+
+type proxyLocalStatsService struct {
+	db   map[string]*proxyLocalStats
+	lock sync.RWMutex
+}
+
+func NewProxyLocalStatsService() akt.ProxyStatsService {
+	return &proxyLocalStatsService{
+		db: make(map[string]*proxyLocalStats),
+	}
+}
+
+func (s *proxyLocalStatsService) Record(ctx context.Context, proxy, profile string, latency time.Duration, err error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id := akt.ProxyID(proxy)
+	v, ok := s.db[id]
+	if !ok {
+		v = &proxyLocalStats{stats: akt.ProxyStats{
+			ID:       id,
+			Proxy:    akt.ProxyRedacted(proxy),
+			Failures: make(map[string]int64),
+			Profiles: make(map[string]akt.ProfileStats),
+		}}
+		s.db[id] = v
+	}
+
+	v.stats.Attempts++
+	v.stats.LastUsed = time.Now()
+	v.latency += latency
+	p := v.stats.Profiles[profile]
+	p.Attempts++
+	if err != nil {
+		v.stats.Failures[errorCode(err)]++
+		v.stats.LastError = err.Error()
+	} else {
+		v.stats.Successes++
+		p.Successes++
+	}
+	v.stats.Profiles[profile] = p
+	return nil
+}
+
+func (s *proxyLocalStatsService) Get(ctx context.Context, id string) (*akt.ProxyStats, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v, ok := s.db[id]
+	if !ok {
+		return nil, errors.ErrNotFound
+	}
+	return v.snapshot(), nil
+}
+
+func (s *proxyLocalStatsService) List(ctx context.Context) ([]*akt.ProxyStats, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	list := make([]*akt.ProxyStats, 0, len(s.db))
+	for _, v := range s.db {
+		list = append(list, v.snapshot())
+	}
+	return list, nil
+}
+
+// snapshot returns a copy of the stats with its derived fields computed.
+func (v *proxyLocalStats) snapshot() *akt.ProxyStats {
+	st := v.stats
+	st.Failures = make(map[string]int64, len(v.stats.Failures))
+	for k, n := range v.stats.Failures {
+		st.Failures[k] = n
+	}
+	st.Profiles = make(map[string]akt.ProfileStats, len(v.stats.Profiles))
+	for k, p := range v.stats.Profiles {
+		st.Profiles[k] = p
+	}
+	derive(&st, v.latency)
+	return &st
+}
+
+// derive computes the failure rate and average latency of st.
+func derive(st *akt.ProxyStats, latency time.Duration) {
+	if st.Attempts == 0 {
+		return
+	}
+	st.FailureRate = float64(st.Attempts-st.Successes) / float64(st.Attempts)
+	st.AvgLatencyMs = latency.Milliseconds() / st.Attempts
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"strings"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+	"github.com/chatgpt-accesstoken/store/redisdb"
+)
+
+// proxyBindingKey is the redis hash binding each email to the ProxyID of
+// its proxy, the proxy itself is found in the pool.
+const proxyBindingKey = "akt:proxy:binding"
+
+type proxyBindingService struct {
+	db *redisdb.Redis
+}
+
+func NewProxyBindingService(db *redisdb.Redis) akt.ProxyBindingService {
+	return &proxyBindingService{db: db}
+}
+
+func (s *proxyBindingService) Get(ctx context.Context, email string) (string, error) {
+	id, err := s.db.HGet(proxyBindingKey, email)
+	if err != nil {
+		return "", err
+	}
+
+	if id == "" {
+		return "", errors.ErrNotFound
+	}
+	if strings.Contains(id, "://") {
+		// bound before the bindings were kept by id.
+		return id, nil
+	}
+
+	pool, err := s.db.HGetAll(proxyKey)
+	if err != nil {
+		return "", err
+	}
+	for proxy := range pool {
+		if akt.ProxyID(proxy) == id {
+			return proxy, nil
+		}
+	}
+	// the proxy left the pool.
+	return "", errors.ErrNotFound
+}
+
+func (s *proxyBindingService) Bind(ctx context.Context, email, proxy string) error {
+	return s.db.HSet(proxyBindingKey, email, akt.ProxyID(proxy))
+}
+
+func (s *proxyBindingService) Unbind(ctx context.Context, email string) error {
+	if v, err := s.db.HGet(proxyBindingKey, email); err != nil || v == "" {
+		if err == nil {
+			err = errors.ErrNotFound
+		}
+		return err
+	}
+	return s.db.HDel(proxyBindingKey, email)
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/store/redisdb"
+)
+
+// proxyCooldownKey is the redis key prefix of the proxies in use or cooling
+// down by ProxyID, each key expires once the proxy can be used again.
+const proxyCooldownKey = "akt:proxy:cooldown:"
+
+type proxyCooldown struct {
+	db *redisdb.Redis
+}
+
+func NewProxyCooldown(db *redisdb.Redis) akt.ProxyCooldown {
+	return &proxyCooldown{db: db}
+}
+
+func (c *proxyCooldown) Acquire(ctx context.Context, proxy string, ttl time.Duration) (bool, error) {
+	return c.db.LockNx(proxyCooldownKey+akt.ProxyID(proxy), "busy", ttl)
+}
+
+func (c *proxyCooldown) Release(ctx context.Context, proxy string, d time.Duration) error {
+	if d <= 0 {
+		return c.db.Del(proxyCooldownKey + akt.ProxyID(proxy))
+	}
+	return c.db.Set(proxyCooldownKey+akt.ProxyID(proxy), "rest", d)
+}
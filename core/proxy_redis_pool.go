@@ -18,11 +18,18 @@ package core
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
 	"github.com/chatgpt-accesstoken/store/redisdb"
 )
 
+// proxyKey is the redis hash holding the shared proxy pool,
+// field is the proxy address and value is the time it was added.
+const proxyKey = "akt:proxy"
+
 type proxyService struct {
 	db *redisdb.Redis
 }
@@ -32,13 +39,53 @@ func NewProxyService(db *redisdb.Redis) akt.ProxyService {
 }
 
 func (s *proxyService) List(ctx context.Context) ([]string, error) {
-	return nil, nil
+	res, err := s.db.HGetAll(proxyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) == 0 {
+		return nil, fmt.Errorf("redis: cannot find proxy")
+	}
+
+	list := make([]string, 0, len(res))
+	for k := range res {
+		list = append(list, k)
+	}
+	return list, nil
 }
 
 func (s *proxyService) Add(ctx context.Context, ip string) error {
+	ip, err := akt.ParseProxy(ip)
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.db.HSetNX(proxyKey, ip, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.NewCode(errors.CodeInvalidRequest, fmt.Sprintf("redis: %s already exists", akt.ProxyRedacted(ip)))
+	}
 	return nil
 }
 
 func (s *proxyService) Delete(ctx context.Context, ip string) error {
-	return nil
+	// the entries added before the urls were normalized are only found as they are.
+	candidates := []string{ip}
+	if v, err := akt.ParseProxy(ip); err == nil && v != ip {
+		candidates = []string{v, ip}
+	}
+
+	for _, proxy := range candidates {
+		v, err := s.db.HGet(proxyKey, proxy)
+		if err != nil {
+			return err
+		}
+		if v != "" {
+			return s.db.HDel(proxyKey, proxy)
+		}
+	}
+	return fmt.Errorf("redis: %s don't exist", akt.ProxyRedacted(ip))
 }
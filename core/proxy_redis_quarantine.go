@@ -0,0 +1,45 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/store/redisdb"
+)
+
+// proxyQuarantineKey is the redis key prefix of the quarantined proxies by
+// ProxyID, each key expires with the quarantine.
+const proxyQuarantineKey = "akt:proxy:quarantine:"
+
+type proxyQuarantine struct {
+	db *redisdb.Redis
+}
+
+func NewProxyQuarantine(db *redisdb.Redis) akt.ProxyQuarantine {
+	return &proxyQuarantine{db: db}
+}
+
+func (q *proxyQuarantine) Quarantine(ctx context.Context, proxy string, ttl time.Duration) error {
+	return q.db.Set(proxyQuarantineKey+akt.ProxyID(proxy), time.Now().Add(ttl).Format(time.RFC3339), ttl)
+}
+
+func (q *proxyQuarantine) Quarantined(ctx context.Context, proxy string) (bool, error) {
+	return q.db.Get(proxyQuarantineKey+akt.ProxyID(proxy)) != "", nil
+}
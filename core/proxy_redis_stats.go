@@ -0,0 +1,156 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+	"github.com/chatgpt-accesstoken/store/redisdb"
+)
+
+// proxyStatsKey is the redis key prefix of the proxy stats, each proxy
+// has a hash of its counters under its id.
+const proxyStatsKey = "akt:proxy:stats:"
+
+// Fields of a proxy stats hash.
+const (
+	statsProxy     = "proxy"
+	statsAttempts  = "attempts"
+	statsSuccesses = "successes"
+	statsFailure   = "failure:"
+	statsLastError = "last_error"
+	statsLastUsed  = "last_used"
+	statsLatency   = "latency_ms"
+	// statsProfileAttempts and statsProfileSuccesses prefix the counters of a client profile.
+	statsProfileAttempts  = "profile_attempts:"
+	statsProfileSuccesses = "profile_successes:"
+)
+
+type proxyStatsService struct {
+	db *redisdb.Redis
+}
+
+func NewProxyStatsService(db *redisdb.Redis) akt.ProxyStatsService {
+	return &proxyStatsService{db: db}
+}
+
+func (s *proxyStatsService) Record(ctx context.Context, proxy, profile string, latency time.Duration, err error) error {
+	counters := map[string]int64{
+		statsAttempts:                  1,
+		statsLatency:                   latency.Milliseconds(),
+		statsProfileAttempts + profile: 1,
+	}
+	fields := map[string]interface{}{
+		statsProxy:    akt.ProxyRedacted(proxy),
+		statsLastUsed: time.Now().UnixMilli(),
+	}
+	if err != nil {
+		counters[statsFailure+errorCode(err)] = 1
+		fields[statsLastError] = err.Error()
+	} else {
+		counters[statsSuccesses] = 1
+		counters[statsProfileSuccesses+profile] = 1
+	}
+
+	key := proxyStatsKey + akt.ProxyID(proxy)
+	for f, n := range counters {
+		if err := s.db.HIncrBy(key, f, n); err != nil {
+			return err
+		}
+	}
+	for f, v := range fields {
+		if err := s.db.HSet(key, f, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *proxyStatsService) Get(ctx context.Context, id string) (*akt.ProxyStats, error) {
+	res, err := s.db.HGetAll(proxyStatsKey + id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) == 0 {
+		return nil, errors.ErrNotFound
+	}
+	return parseProxyStats(id, res), nil
+}
+
+func (s *proxyStatsService) List(ctx context.Context) ([]*akt.ProxyStats, error) {
+	keys, err := s.db.Scan(proxyStatsKey + "*")
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*akt.ProxyStats, 0, len(keys))
+	for _, key := range keys {
+		st, err := s.Get(ctx, strings.TrimPrefix(key, proxyStatsKey))
+		if err == errors.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, st)
+	}
+	return list, nil
+}
+
+func parseProxyStats(id string, res map[string]string) *akt.ProxyStats {
+	st := &akt.ProxyStats{
+		ID:        id,
+		Proxy:     res[statsProxy],
+		Failures:  make(map[string]int64),
+		LastError: res[statsLastError],
+		Profiles:  make(map[string]akt.ProfileStats),
+	}
+
+	var latency int64
+	for k, v := range res {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		switch {
+		case k == statsAttempts:
+			st.Attempts = n
+		case k == statsSuccesses:
+			st.Successes = n
+		case k == statsLatency:
+			latency = n
+		case k == statsLastUsed:
+			st.LastUsed = time.UnixMilli(n)
+		case strings.HasPrefix(k, statsFailure):
+			st.Failures[strings.TrimPrefix(k, statsFailure)] = n
+		case strings.HasPrefix(k, statsProfileAttempts):
+			name := strings.TrimPrefix(k, statsProfileAttempts)
+			p := st.Profiles[name]
+			p.Attempts = n
+			st.Profiles[name] = p
+		case strings.HasPrefix(k, statsProfileSuccesses):
+			name := strings.TrimPrefix(k, statsProfileSuccesses)
+			p := st.Profiles[name]
+			p.Successes = n
+			st.Profiles[name] = p
+		}
+	}
+	derive(st, time.Duration(latency)*time.Millisecond)
+	return st
+}
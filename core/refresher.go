@@ -0,0 +1,316 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/workpieces/log"
+
+	akt "github.com/chatgpt-accesstoken"
+)
+
+// refresherLockKey is the lock held by the replica running the refresher.
+const refresherLockKey = "refresher"
+
+type refreshKey struct{}
+
+// withRefresh returns a context logging in again whatever the cached token.
+func withRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, refreshKey{}, true)
+}
+
+// refreshing reports whether ctx logs in again whatever the cached token.
+func refreshing(ctx context.Context) bool {
+	v, _ := ctx.Value(refreshKey{}).(bool)
+	return v
+}
+
+// forced reports whether req logs in again whatever the cached token.
+func forced(ctx context.Context, req *akt.OpenaiAuthRequest) bool {
+	return req.ForceRefresh || refreshing(ctx)
+}
+
+// Refresher logs in again the accounts whose cached token expires soon.
+type Refresher struct {
+	svc       akt.OpenaiAuthService
+	akStore   akt.AccessTokenStore
+	credStore akt.CredentialStore
+	logger    log.Logger
+
+	accountSvc akt.AccountService
+
+	window      time.Duration
+	interval    time.Duration
+	concurrency int
+	locker      akt.Locker
+
+	// failures are the refreshes failed in a row by email.
+	lock     sync.Mutex
+	failures map[string]refreshFailure
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// refreshFailure holds off the refreshes of an email failing in a row.
+type refreshFailure struct {
+	count int
+	next  time.Time
+}
+
+// maxRefreshBackoff caps the wait before refreshing again an email failing in a row.
+const maxRefreshBackoff = 24 * time.Hour
+
+// RefresherOption configures the token refresher.
+type RefresherOption func(*Refresher)
+
+// WithRefresherLocker runs the refresher on a single replica at a time.
+func WithRefresherLocker(locker akt.Locker) RefresherOption {
+	return func(r *Refresher) {
+		r.locker = locker
+	}
+}
+
+// WithRefresherAccounts logs the registered accounts in with their own
+// request, so that their mfa secret and preferred proxy are kept.
+func WithRefresherAccounts(accountSvc akt.AccountService) RefresherOption {
+	return func(r *Refresher) {
+		r.accountSvc = accountSvc
+	}
+}
+
+// NewRefresher returns a Refresher scanning akStore every interval and
+// refreshing, at most concurrency at a time, the tokens expiring within
+// window. svc must be the cache so that refreshed tokens are stored and
+// proxies cool down between logins.
+func NewRefresher(svc akt.OpenaiAuthService, akStore akt.AccessTokenStore, credStore akt.CredentialStore, logger log.Logger,
+	window, interval time.Duration, concurrency int, opts ...RefresherOption) *Refresher {
+	r := &Refresher{
+		svc:         svc,
+		akStore:     akStore,
+		credStore:   credStore,
+		logger:      logger.WithField("token", "refresher"),
+		window:      window,
+		interval:    interval,
+		concurrency: concurrency,
+		failures:    make(map[string]refreshFailure),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Start runs the refresher until Close.
+func (r *Refresher) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.run(ctx)
+			}
+		}
+	}()
+}
+
+// Close stops the refresher and waits for the running refreshes.
+func (r *Refresher) Close(ctx context.Context) error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.done:
+		return nil
+	}
+}
+
+// run refreshes the expiring tokens unless another replica does.
+func (r *Refresher) run(ctx context.Context) {
+	if r.locker != nil {
+		token, err := r.locker.Lock(ctx, refresherLockKey, r.interval)
+		if err != nil {
+			r.logger.Error(fmt.Sprintf("refresher: cannot lock: %s", err))
+			return
+		}
+		if token == "" {
+			return
+		}
+		defer r.locker.Unlock(context.Background(), refresherLockKey, token)
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go r.renew(ctx, cancel, token)
+	}
+
+	if err := r.scan(ctx); err != nil {
+		r.logger.Error(fmt.Sprintf("refresher: cannot scan tokens: %s", err))
+	}
+}
+
+// renew holds the refresher lock as long as the scan lasts, the scan is
+// cancelled once the lock is lost to another replica.
+func (r *Refresher) renew(ctx context.Context, cancel context.CancelFunc, token string) {
+	ticker := time.NewTicker(r.interval / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ok, err := r.locker.Extend(ctx, refresherLockKey, token, r.interval)
+		if err != nil {
+			r.logger.Error(fmt.Sprintf("refresher: cannot extend lock: %s", err))
+			continue
+		}
+		if !ok {
+			r.logger.Error("refresher: lock lost, stop the scan")
+			cancel()
+			return
+		}
+	}
+}
+
+// scan refreshes the tokens expiring within the window. The expired ones
+// are left to be logged in again on demand, and an email failing in a row
+// is held off for twice as long after each failure.
+func (r *Refresher) scan(ctx context.Context) error {
+	list, err := r.akStore.List(ctx)
+	if err != nil {
+		return err
+	}
+	accounts, err := r.accounts(ctx)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, r.concurrency)
+	for _, email := range list {
+		res, err := r.akStore.Get(ctx, email)
+		if err != nil || time.Until(res.Expires) > r.window || !time.Now().Before(res.Expires) || r.holding(email) {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(email string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r.refresh(ctx, email, accounts[email])
+		}(email)
+	}
+	wg.Wait()
+	return nil
+}
+
+// accounts returns the registered accounts by email.
+func (r *Refresher) accounts(ctx context.Context) (map[string]*akt.Account, error) {
+	if r.accountSvc == nil {
+		return nil, nil
+	}
+
+	list, err := r.accountSvc.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	accounts := make(map[string]*akt.Account, len(list))
+	for _, account := range list {
+		accounts[account.Email] = account
+	}
+	return accounts, nil
+}
+
+// refresh logs email in again, with the request of its account if registered.
+func (r *Refresher) refresh(ctx context.Context, email string, account *akt.Account) {
+	rlog := r.logger.WithField("email", email)
+
+	var req *akt.OpenaiAuthRequest
+	if account != nil {
+		req = account.AuthRequest()
+	} else {
+		password, err := r.credStore.Get(ctx, email)
+		if err != nil {
+			rlog.Info("refresher: no credentials, skip")
+			return
+		}
+		req = &akt.OpenaiAuthRequest{Email: email, Password: password}
+	}
+
+	_, err := r.svc.AccessToken(withRefresh(ctx), req)
+	if err != nil {
+		backoff := r.fail(email)
+		rlog.WithField("backoff", backoff).Error(fmt.Sprintf("refresher: cannot refresh token: %s", err))
+		return
+	}
+
+	r.lock.Lock()
+	delete(r.failures, email)
+	r.lock.Unlock()
+	rlog.Info("refresher: token refreshed")
+}
+
+// holding reports whether the refreshes of email are held off after failures.
+func (r *Refresher) holding(email string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f, ok := r.failures[email]
+	return ok && time.Now().Before(f.next)
+}
+
+// fail records a failed refresh of email, returns how long it is held off.
+func (r *Refresher) fail(email string) time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f := r.failures[email]
+	backoff := r.interval << f.count
+	if backoff <= 0 || backoff > maxRefreshBackoff {
+		backoff = maxRefreshBackoff
+	} else {
+		f.count++
+	}
+	f.next = time.Now().Add(backoff)
+	r.failures[email] = f
+	return backoff
+}
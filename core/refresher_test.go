@@ -0,0 +1,126 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+	"github.com/workpieces/log"
+
+	akt "github.com/chatgpt-accesstoken"
+	errors2 "github.com/chatgpt-accesstoken/errors"
+)
+
+func TestRefresherScan(t *testing.T) {
+	ctx := context.Background()
+	upstream := new(countingAuthService)
+	akStore := NewAccessTokenStore()
+	credStore := NewCredentialStore()
+	svc := NewOpenaiAuthCache(newTestProxyService(t), upstream, akStore, log.NewNop(), WithCredentials(credStore))
+
+	// a@b.c logs in through the cache, d@e.f and g@h.i were cached without credentials.
+	if _, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	expiring := func(email string, in time.Duration) {
+		akStore.Add(ctx, email, &akt.AuthExpireResult{
+			AuthResult: &auth.AuthResult{AccessToken: "old"},
+			Expires:    time.Now().Add(in),
+		})
+	}
+	expiring("a@b.c", 10*time.Minute)
+	expiring("d@e.f", 10*time.Minute)
+	expiring("g@h.i", time.Hour)
+	// j@k.l expired, it is logged in again on demand.
+	credStore.Set(ctx, "j@k.l", "secret")
+	expiring("j@k.l", -time.Minute)
+
+	r := NewRefresher(svc, akStore, credStore, log.NewNop(), 30*time.Minute, time.Minute, 2)
+	if err := r.scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := atomic.LoadInt32(&upstream.calls), int32(2); got != want {
+		t.Errorf("Want %d upstream logins, got %d", want, got)
+	}
+	if res, _ := akStore.Get(ctx, "a@b.c"); res.AccessToken != "token-a@b.c" || time.Until(res.Expires) < time.Hour {
+		t.Errorf("Want a@b.c refreshed, got %+v", res)
+	}
+	for _, email := range []string{"d@e.f", "g@h.i", "j@k.l"} {
+		if res, _ := akStore.Get(ctx, email); res.AccessToken != "old" {
+			t.Errorf("Want %s not refreshed, got %+v", email, res)
+		}
+	}
+}
+
+func TestRefresherAccount(t *testing.T) {
+	ctx := context.Background()
+	upstream := new(countingAuthService)
+	akStore := NewAccessTokenStore()
+	accountSvc := NewAccountLocalService()
+	svc := NewOpenaiAuthCache(newTestProxyService(t), upstream, akStore, log.NewNop())
+
+	account := &akt.Account{Email: "a@b.c", Password: "secret", MFASecret: "JBSWY3DPEHPK3PXP", PreferredProxy: "http://c:d@127.0.0.1:2"}
+	if err := accountSvc.Create(ctx, account); err != nil {
+		t.Fatal(err)
+	}
+	akStore.Add(ctx, "a@b.c", &akt.AuthExpireResult{AuthResult: &auth.AuthResult{AccessToken: "old"}, Expires: time.Now().Add(10 * time.Minute)})
+
+	// the account is refreshed without any remembered credentials.
+	r := NewRefresher(svc, akStore, NewCredentialStore(), log.NewNop(), 30*time.Minute, time.Minute, 1, WithRefresherAccounts(accountSvc))
+	if err := r.scan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := atomic.LoadInt32(&upstream.calls), int32(1); got != want {
+		t.Fatalf("Want %d upstream login, got %d", want, got)
+	}
+	if upstream.proxy != account.PreferredProxy || upstream.mfa != account.MFASecret {
+		t.Errorf("Want the account request refreshed, got proxy %s and mfa %q", upstream.proxy, upstream.mfa)
+	}
+}
+
+func TestRefresherBackoff(t *testing.T) {
+	ctx := context.Background()
+	upstream := &countingAuthService{err: errors2.ErrMFARejected}
+	akStore := NewAccessTokenStore()
+	credStore := NewCredentialStore()
+	svc := NewOpenaiAuthCache(newTestProxyService(t), upstream, akStore, log.NewNop(), WithCredentials(credStore))
+
+	credStore.Set(ctx, "a@b.c", "secret")
+	akStore.Add(ctx, "a@b.c", &akt.AuthExpireResult{AuthResult: &auth.AuthResult{AccessToken: "old"}, Expires: time.Now().Add(10 * time.Minute)})
+
+	r := NewRefresher(svc, akStore, credStore, log.NewNop(), 30*time.Minute, time.Minute, 1)
+	for i := 0; i < 3; i++ {
+		if err := r.scan(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := atomic.LoadInt32(&upstream.calls), int32(1); got != want {
+		t.Errorf("Want %d upstream login of the failing account, got %d", want, got)
+	}
+
+	// held off twice as long after each failure.
+	r.failures["a@b.c"] = refreshFailure{count: 1}
+	r.scan(ctx)
+	if got := time.Until(r.failures["a@b.c"].next); got <= time.Minute || got > 2*time.Minute {
+		t.Errorf("Want the account held off 2m, got %s", got)
+	}
+}
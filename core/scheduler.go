@@ -0,0 +1,238 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	akt "github.com/chatgpt-accesstoken"
+)
+
+// Proxy scheduling strategies.
+const (
+	StrategyRandom        = "random"
+	StrategyRoundRobin    = "round_robin"
+	StrategyLeastRecent   = "lru"
+	StrategyWeighted      = "weighted"
+	StrategyLeastFailures = "least_failures"
+)
+
+// NewScheduler returns the scheduler of strategy, failures older than
+// window are forgotten by the least_failures strategy.
+func NewScheduler(strategy string, window time.Duration) (akt.Scheduler, error) {
+	switch strategy {
+	case StrategyRandom, "":
+		return new(randomScheduler), nil
+	case StrategyRoundRobin:
+		return new(roundRobinScheduler), nil
+	case StrategyLeastRecent:
+		return &lruScheduler{used: make(map[string]time.Time)}, nil
+	case StrategyWeighted:
+		return &weightedScheduler{stats: make(map[string]*weight)}, nil
+	case StrategyLeastFailures:
+		return &leastFailuresScheduler{window: window, failures: make(map[string][]time.Time)}, nil
+	}
+	return nil, fmt.Errorf("scheduler: unknown strategy %q", strategy)
+}
+
+// randomScheduler picks any candidate.
+type randomScheduler struct{}
+
+func (s *randomScheduler) Pick(ctx context.Context, candidates []string) (string, error) {
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("scheduler: cannot find proxy")
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
+
+func (s *randomScheduler) Report(ctx context.Context, proxy string, err error) {}
+
+// roundRobinScheduler walks the candidates in order, starting after the last pick.
+type roundRobinScheduler struct {
+	last string
+	lock sync.Mutex
+}
+
+func (s *roundRobinScheduler) Pick(ctx context.Context, candidates []string) (string, error) {
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("scheduler: cannot find proxy")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sorted := append([]string(nil), candidates...)
+	sort.Strings(sorted)
+
+	next := sorted[0]
+	if i := sort.SearchStrings(sorted, s.last); i < len(sorted) {
+		if sorted[i] != s.last {
+			next = sorted[i]
+		} else if i+1 < len(sorted) {
+			next = sorted[i+1]
+		}
+	}
+	s.last = next
+	return next, nil
+}
+
+func (s *roundRobinScheduler) Report(ctx context.Context, proxy string, err error) {}
+
+// lruScheduler picks the candidate which has not been picked for the longest time.
+type lruScheduler struct {
+	used map[string]time.Time
+	lock sync.Mutex
+}
+
+func (s *lruScheduler) Pick(ctx context.Context, candidates []string) (string, error) {
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("scheduler: cannot find proxy")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var next string
+	for _, i := range rand.Perm(len(candidates)) {
+		proxy := candidates[i]
+		if next == "" || s.used[proxy].Before(s.used[next]) {
+			next = proxy
+		}
+	}
+	s.used[next] = time.Now()
+	return next, nil
+}
+
+func (s *lruScheduler) Report(ctx context.Context, proxy string, err error) {}
+
+type weight struct {
+	attempts  int
+	successes int
+}
+
+// weightedScheduler picks a candidate with a probability following its
+// success rate, a proxy without history gets an even chance.
+type weightedScheduler struct {
+	stats map[string]*weight
+	lock  sync.Mutex
+}
+
+func (s *weightedScheduler) Pick(ctx context.Context, candidates []string) (string, error) {
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("scheduler: cannot find proxy")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	weights := make([]float64, len(candidates))
+	var total float64
+	for i, proxy := range candidates {
+		w := 0.5
+		if st, ok := s.stats[proxy]; ok {
+			w = float64(st.successes+1) / float64(st.attempts+2)
+		}
+		weights[i] = w
+		total += w
+	}
+
+	n := rand.Float64() * total
+	for i, w := range weights {
+		if n < w {
+			return candidates[i], nil
+		}
+		n -= w
+	}
+	return candidates[len(candidates)-1], nil
+}
+
+func (s *weightedScheduler) Report(ctx context.Context, proxy string, err error) {
+	if err != nil && !proxyFailure(err) {
+		// the account failed, not the proxy.
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.stats[proxy]
+	if !ok {
+		st = new(weight)
+		s.stats[proxy] = st
+	}
+	st.attempts++
+	if err == nil {
+		st.successes++
+	}
+}
+
+// leastFailuresScheduler picks the candidate with the fewest proxy failures
+// within the window, ties are broken randomly.
+type leastFailuresScheduler struct {
+	window   time.Duration
+	failures map[string][]time.Time
+	lock     sync.Mutex
+}
+
+func (s *leastFailuresScheduler) Pick(ctx context.Context, candidates []string) (string, error) {
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("scheduler: cannot find proxy")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	next, fewest := "", -1
+	for _, i := range rand.Perm(len(candidates)) {
+		proxy := candidates[i]
+		if n := len(s.recent(proxy)); fewest < 0 || n < fewest {
+			next, fewest = proxy, n
+		}
+	}
+	return next, nil
+}
+
+func (s *leastFailuresScheduler) Report(ctx context.Context, proxy string, err error) {
+	if err == nil || !proxyFailure(err) {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.failures[proxy] = append(s.recent(proxy), time.Now())
+}
+
+// recent drops the failures of proxy older than the window.
+func (s *leastFailuresScheduler) recent(proxy string) []time.Time {
+	failures := s.failures[proxy]
+	since := time.Now().Add(-s.window)
+	for len(failures) > 0 && failures[0].Before(since) {
+		failures = failures[1:]
+	}
+	if len(failures) == 0 {
+		delete(s.failures, proxy)
+		return nil
+	}
+	s.failures[proxy] = failures
+	return failures
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+)
+
+func TestNewScheduler(t *testing.T) {
+	for _, strategy := range []string{"", StrategyRandom, StrategyRoundRobin, StrategyLeastRecent, StrategyWeighted, StrategyLeastFailures} {
+		if _, err := NewScheduler(strategy, time.Minute); err != nil {
+			t.Errorf("Want strategy %q supported, got error %s", strategy, err)
+		}
+	}
+	if _, err := NewScheduler("fastest", time.Minute); err == nil {
+		t.Errorf("Want error for an unknown strategy")
+	}
+}
+
+func TestSchedulerRotation(t *testing.T) {
+	candidates := []string{"c", "a", "b"}
+	for _, strategy := range []string{StrategyRoundRobin, StrategyLeastRecent} {
+		t.Run(strategy, func(t *testing.T) {
+			s, _ := NewScheduler(strategy, time.Minute)
+			seen := make(map[string]bool)
+			for i := 0; i < len(candidates); i++ {
+				proxy, err := s.Pick(context.Background(), candidates)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if seen[proxy] {
+					t.Errorf("Want every candidate picked once per round, got %s twice", proxy)
+				}
+				seen[proxy] = true
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestSchedulerFailures(t *testing.T) {
+	failure := OError{Err: auth.NewError("part_one", 0, "Failed to send request", errors.New("connection refused"))}
+	credential := OError{Err: auth.NewError("__part_five", 400, "Wrong email or password", errors.New("error: Check details"))}
+
+	for _, strategy := range []string{StrategyWeighted, StrategyLeastFailures} {
+		t.Run(strategy, func(t *testing.T) {
+			ctx := context.Background()
+			s, _ := NewScheduler(strategy, time.Minute)
+			for i := 0; i < 50; i++ {
+				s.Report(ctx, "bad", failure)
+				s.Report(ctx, "good", nil)
+				s.Report(ctx, "good", credential)
+			}
+
+			picks := make(map[string]int)
+			for i := 0; i < 100; i++ {
+				proxy, _ := s.Pick(ctx, []string{"bad", "good"})
+				picks[proxy]++
+			}
+			if picks["good"] <= picks["bad"]*5 {
+				t.Errorf("Want the failing proxy avoided, got %v", picks)
+			}
+		})
+	}
+}
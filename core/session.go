@@ -0,0 +1,34 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+
+	http "github.com/bogdanfinn/fhttp"
+	tls_client "github.com/bogdanfinn/tls-client"
+)
+
+// contextSession cancels the upstream requests of a login when ctx is done.
+type contextSession struct {
+	tls_client.HttpClient
+	ctx context.Context
+}
+
+func (s *contextSession) Do(req *http.Request) (*http.Response, error) {
+	return s.HttpClient.Do(req.WithContext(s.ctx))
+}
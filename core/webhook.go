@@ -0,0 +1,230 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/workpieces/log"
+
+	akt "github.com/chatgpt-accesstoken"
+)
+
+// Headers of a webhook delivery.
+const (
+	webhookEventHeader     = "X-Akt-Event"
+	webhookDeliveryHeader  = "X-Akt-Delivery"
+	webhookSignatureHeader = "X-Akt-Signature"
+)
+
+// Webhook posts the events as json to each of its urls. The body is signed
+// with the HMAC-SHA256 of the secret in the X-Akt-Signature header as
+// sha256=<hex>. Each url is delivered in order from its own queue, so that
+// an endpoint down only holds its own events back. A delivery failing every
+// attempt is appended to the dead letter file.
+type Webhook struct {
+	urls       []string
+	secret     []byte
+	attempts   int
+	backoff    time.Duration
+	deadLetter string
+	logger     log.Logger
+	client     *http.Client
+
+	// queues the events to deliver by url.
+	queues map[string]chan *akt.Event
+	// ctx aborts the deliveries once Close gives up waiting for them.
+	ctx    context.Context
+	abort  context.CancelFunc
+	wg     sync.WaitGroup
+	lock   sync.Mutex
+	closed bool
+}
+
+// NewWebhook returns a Webhook trying each delivery attempts times, the
+// backoff between two attempts doubles after each one. An empty deadLetter
+// only logs the failed deliveries.
+func NewWebhook(urls []string, secret string, attempts int, backoff time.Duration, deadLetter string, logger log.Logger) *Webhook {
+	w := &Webhook{
+		urls:       urls,
+		secret:     []byte(secret),
+		attempts:   attempts,
+		backoff:    backoff,
+		deadLetter: deadLetter,
+		logger:     logger.WithField("webhook", "notifier"),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		queues:     make(map[string]chan *akt.Event, len(urls)),
+	}
+	for _, url := range urls {
+		w.queues[url] = make(chan *akt.Event, 1000)
+	}
+	w.ctx, w.abort = context.WithCancel(context.Background())
+	return w
+}
+
+// Start delivers the events until Close.
+func (w *Webhook) Start() {
+	for url, queue := range w.queues {
+		w.wg.Add(1)
+		go func(url string, queue chan *akt.Event) {
+			defer w.wg.Done()
+			for event := range queue {
+				w.deliver(url, event)
+			}
+		}(url, queue)
+	}
+}
+
+// Close stops accepting events and waits for the queued ones to be
+// delivered until ctx is done, the deliveries left are then aborted and
+// dead lettered.
+func (w *Webhook) Close(ctx context.Context) error {
+	w.lock.Lock()
+	if !w.closed {
+		w.closed = true
+		for _, queue := range w.queues {
+			close(queue)
+		}
+	}
+	w.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		w.abort()
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+func (w *Webhook) Notify(ctx context.Context, event *akt.Event) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		w.dead("", event, fmt.Errorf("webhook: closed"))
+		return
+	}
+
+	for _, url := range w.urls {
+		select {
+		case w.queues[url] <- event:
+		default:
+			w.dead(url, event, fmt.Errorf("webhook: queue is full"))
+		}
+	}
+}
+
+// deliver posts event to url, retrying after a backoff until the attempts
+// are exhausted or the deliveries are aborted.
+func (w *Webhook) deliver(url string, event *akt.Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		w.dead(url, event, err)
+		return
+	}
+
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		err = w.send(url, event, body)
+		if err == nil {
+			return
+		}
+		if attempt >= w.attempts {
+			break
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-w.ctx.Done():
+			timer.Stop()
+			w.dead(url, event, fmt.Errorf("webhook: aborted on close: %s", err))
+			return
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+	w.dead(url, event, err)
+}
+
+func (w *Webhook) send(url string, event *akt.Event, body []byte) error {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event.Type)
+	req.Header.Set(webhookDeliveryHeader, event.ID)
+	req.Header.Set(webhookSignatureHeader, "sha256="+Sign(w.secret, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: %s responded %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of body with secret.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// dead records the event which could not be delivered to url.
+func (w *Webhook) dead(url string, event *akt.Event, err error) {
+	w.logger.WithField("url", url).WithField("event", event.ID).Error(fmt.Sprintf("webhook: cannot deliver %s: %s", event.Type, err))
+	if w.deadLetter == "" {
+		return
+	}
+
+	line, _ := json.Marshal(struct {
+		Time  time.Time  `json:"time"`
+		URL   string     `json:"url,omitempty"`
+		Error string     `json:"error"`
+		Event *akt.Event `json:"event"`
+	}{Time: time.Now(), URL: url, Error: err.Error(), Event: event})
+
+	f, ferr := os.OpenFile(w.deadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if ferr != nil {
+		w.logger.Error(fmt.Sprintf("webhook: cannot open dead letter file: %s", ferr))
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/workpieces/log"
+
+	akt "github.com/chatgpt-accesstoken"
+)
+
+// recordingNotifier keeps the events notified.
+type recordingNotifier struct {
+	lock   sync.Mutex
+	events []*akt.Event
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, event *akt.Event) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.events = append(n.events, event)
+}
+
+func TestOpenaiAuthNotifier(t *testing.T) {
+	ctx := context.Background()
+	broken, working := "http://a:b@127.0.0.1:1", "http://a:b@127.0.0.1:2"
+	proxySvc := NewProxyLocalService()
+	for _, proxy := range []string{broken, working} {
+		if err := proxySvc.Add(ctx, proxy); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upstream := NewFakeUpstream(
+		FakeRule{Email: "banned@b.c", Location: "__part_five", Status: 403, Details: "Your account has been deactivated"},
+		FakeRule{Proxy: broken, Details: "Failed to send request"},
+	)
+	akStore := NewAccessTokenStore()
+	notifier := new(recordingNotifier)
+	svc := NewOpenaiAuthNotifier(notifier, NewOpenaiAuthCache(proxySvc, New(WithAuthenticator(upstream)),
+		akStore, log.NewNop(), WithRetry(2, 0)))
+	req := &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "p"}
+
+	// a single event however many proxies the login tried, none for the cached token.
+	if _, err := svc.AccessToken(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.AccessToken(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.AccessToken(withRefresh(ctx), req); err != nil {
+		t.Fatal(err)
+	}
+
+	// the login replacing an expired token refreshes it.
+	res, _ := akStore.Get(ctx, req.Email)
+	res.Expires = time.Now().Add(-time.Minute)
+	akStore.Add(ctx, req.Email, res)
+	if _, err := svc.AccessToken(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "banned@b.c", Password: "p"}); err == nil {
+		t.Fatal("Want error of the banned account")
+	}
+
+	var types []string
+	for _, event := range notifier.events {
+		types = append(types, event.Type)
+	}
+	want := []string{akt.EventTokenIssued, akt.EventTokenRefreshed, akt.EventTokenRefreshed, akt.EventTokenFailed, akt.EventAccountBanned}
+	if len(types) != len(want) {
+		t.Fatalf("Want events %v, got %v", want, types)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Errorf("Want events %v, got %v", want, types)
+			break
+		}
+	}
+	if got := notifier.events[0].ProxyID; got != akt.ProxyID(working) {
+		t.Errorf("Want the event of the working proxy, got %s", got)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var calls int32
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got, want := r.Header.Get(webhookSignatureHeader), "sha256="+Sign([]byte("secret"), body); got != want {
+			t.Errorf("Want signature %q, got %q", want, got)
+		}
+		if got, want := r.Header.Get(webhookEventHeader), akt.EventTokenIssued; got != want {
+			t.Errorf("Want event %q, got %q", want, got)
+		}
+		// fail the first delivery to be retried.
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ok.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	webhook := NewWebhook([]string{ok.URL, broken.URL}, "secret", 3, time.Millisecond, deadLetter, log.NewNop())
+	webhook.Start()
+
+	webhook.Notify(context.Background(), &akt.Event{ID: "1", Type: akt.EventTokenIssued, Email: "a@b.c", Time: time.Now()})
+	if err := webhook.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := atomic.LoadInt32(&calls), int32(2); got != want {
+		t.Errorf("Want %d deliveries, got %d", want, got)
+	}
+
+	f, err := os.Open(deadLetter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	type deadLine struct {
+		URL   string     `json:"url"`
+		Event *akt.Event `json:"event"`
+	}
+	var lines []deadLine
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line deadLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 1 || lines[0].URL != broken.URL || lines[0].Event.ID != "1" {
+		t.Errorf("Want the event undelivered to %s dead lettered, got %+v", broken.URL, lines)
+	}
+}
+
+func TestWebhookDownEndpoint(t *testing.T) {
+	var calls int32
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer ok.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	webhook := NewWebhook([]string{down.URL, ok.URL}, "secret", 3, time.Hour, "", log.NewNop())
+	webhook.Start()
+	for _, id := range []string{"1", "2", "3"} {
+		webhook.Notify(context.Background(), &akt.Event{ID: id, Type: akt.EventTokenIssued, Time: time.Now()})
+	}
+
+	// the endpoint down backing off does not hold the other one back.
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&calls) < 3 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+	if got, want := atomic.LoadInt32(&calls), int32(3); got != want {
+		t.Errorf("Want %d deliveries to the endpoint up, got %d", want, got)
+	}
+
+	// close gives up the backoff once its ctx is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := webhook.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Want drain deadline, got %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		webhook.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Want the backoff aborted, still delivering after %s", time.Since(start))
+	}
+}
@@ -14,23 +14,66 @@
 
 package errors
 
+// Codes of the API errors, stable for clients to switch on.
+const (
+	CodeUnknown            = "unknown"
+	CodeInvalidRequest     = "invalid_request"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeNotImplemented     = "not_implemented"
+	CodePasswordMismatch   = "password_mismatch"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeAccountBanned      = "account_banned"
+	CodeMFARequired        = "mfa_required"
+	CodeMFARejected        = "mfa_rejected"
+	CodeCloudflare         = "cloudflare_challenge"
+	CodeRateLimited        = "rate_limited"
+	CodeProxy              = "proxy_error"
+	CodeUpstream           = "upstream_error"
+	CodeTimeout            = "timeout"
+	CodeUnavailable        = "unavailable"
+)
+
 var (
 	// ErrInvalidToken is returned when the api request token is invalid.
-	ErrInvalidToken = New("Invalid or missing token")
+	ErrInvalidToken = NewCode(CodeUnauthorized, "Invalid or missing token")
 
 	// ErrUnauthorized is returned when the user is not authorized.
-	ErrUnauthorized = New("Unauthorized")
+	ErrUnauthorized = NewCode(CodeUnauthorized, "Unauthorized")
 
 	// ErrForbidden is returned when user access is forbidden.
-	ErrForbidden = New("Forbidden")
+	ErrForbidden = NewCode(CodeForbidden, "Forbidden")
 
 	// ErrNotFound is returned when a resource is not found.
-	ErrNotFound = New("Not Found")
+	ErrNotFound = NewCode(CodeNotFound, "Not Found")
+
+	// ErrPasswordMismatch is returned when the password does not match
+	// the one a cached access token was issued for.
+	ErrPasswordMismatch = NewCode(CodePasswordMismatch, "Password does not match")
+
+	// ErrMFARequired is returned when the account asks for a one-time code
+	// and no TOTP secret was given.
+	ErrMFARequired = NewCode(CodeMFARequired, "MFA code is required")
+
+	// ErrMFARejected is returned when the upstream rejects the one-time code.
+	ErrMFARejected = NewCode(CodeMFARejected, "MFA code was rejected")
+
+	// ErrLoginTimeout is returned when an upstream login is cancelled or
+	// runs out of time.
+	ErrLoginTimeout = NewCode(CodeTimeout, "Login timed out")
+
+	// ErrShuttingDown is returned when a login starts while the server
+	// drains the running ones.
+	ErrShuttingDown = NewCode(CodeUnavailable, "Server is shutting down")
 )
 
 // Error represents a json-encoded API error.
 type Error struct {
-	Message string `json:"message"`
+	Code           string `json:"code"`
+	Message        string `json:"message"`
+	Location       string `json:"location"`        // Location step of the upstream login which failed.
+	UpstreamStatus int    `json:"upstream_status"` // UpstreamStatus http status returned by the upstream, 0 without response.
 }
 
 func (e *Error) Error() string {
@@ -41,3 +84,8 @@ func (e *Error) Error() string {
 func New(text string) error {
 	return &Error{Message: text}
 }
+
+// NewCode returns a new error message with a code.
+func NewCode(code, text string) error {
+	return &Error{Code: code, Message: text}
+}
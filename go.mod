@@ -4,18 +4,22 @@ go 1.20
 
 require (
 	github.com/acheong08/OpenAIAuth v0.0.0-20230625142757-7b01ccd04f63
+	github.com/alicebob/miniredis/v2 v2.30.5
 	github.com/asaskevich/govalidator v0.0.0-20230301143203-a9d515a09cc2
+	github.com/bogdanfinn/fhttp v0.5.19
+	github.com/bogdanfinn/tls-client v1.3.8
 	github.com/gin-gonic/gin v1.9.1
 	github.com/go-redis/redis/v8 v8.11.5
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/spf13/cobra v1.7.0
 	github.com/workpieces/log v0.0.0-20230331052800-717da148c7ce
+	golang.org/x/crypto v0.9.0
+	golang.org/x/sync v0.3.0
 )
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
 	github.com/andybalholm/brotli v1.0.4 // indirect
-	github.com/bogdanfinn/fhttp v0.5.19 // indirect
-	github.com/bogdanfinn/tls-client v1.3.8 // indirect
 	github.com/bogdanfinn/utls v1.5.15 // indirect
 	github.com/bytedance/sonic v1.9.1 // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
@@ -42,8 +46,8 @@ require (
 	github.com/tam7t/hpkp v0.0.0-20160821193359-2b70b4024ed5 // indirect
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	github.com/ugorji/go/codec v1.2.11 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
 	golang.org/x/arch v0.3.0 // indirect
-	golang.org/x/crypto v0.9.0 // indirect
 	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
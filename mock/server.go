@@ -0,0 +1,320 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mock provides a local stand-in of the OpenAI login endpoints, to
+// run the logins against with core.WithEndpoints.
+package mock
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/chatgpt-accesstoken/core"
+)
+
+// redirectURI is where the login ends, the upstream library reads the code from it.
+const redirectURI = "com.openai.chat://auth0.openai.com/ios/com.openai.chat/callback"
+
+// Account is an account the mock logs in.
+type Account struct {
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	MFASecret string `json:"mfa_secret,omitempty"` // MFASecret asks for the TOTP code of this base32 secret.
+	Banned    bool   `json:"banned,omitempty"`     // Banned rejects the password of a deactivated account.
+}
+
+// Handler implements the login redirects of auth0.openai.com, the token
+// endpoint, and the session and models endpoints of chat.openai.com.
+type Handler struct {
+	// TTL lifetime of the access tokens issued, 1h by default.
+	TTL time.Duration
+
+	lock     sync.Mutex
+	accounts map[string]*Account
+	states   map[string]string // states login state to email.
+	verified map[string]bool   // verified login states whose one-time code was answered.
+	codes    map[string]string // codes authorization code to email.
+	tokens   map[string]string // tokens access token to email.
+	logins   map[string]int
+}
+
+func NewHandler(accounts ...Account) *Handler {
+	h := &Handler{
+		TTL:      time.Hour,
+		accounts: make(map[string]*Account),
+		states:   make(map[string]string),
+		verified: make(map[string]bool),
+		codes:    make(map[string]string),
+		tokens:   make(map[string]string),
+		logins:   make(map[string]int),
+	}
+	for _, account := range accounts {
+		h.AddAccount(account)
+	}
+	return h
+}
+
+// AddAccount adds or replaces the account of account.Email.
+func (h *Handler) AddAccount(account Account) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.accounts[account.Email] = &account
+}
+
+// Logins returns the number of tokens issued to email.
+func (h *Handler) Logins(email string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.logins[email]
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/authorize":
+		h.authorize(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/u/login/identifier":
+		// the upstream library reads the state from the page.
+		fmt.Fprintf(w, `<form action="/u/login/identifier?state=%s"></form>`, r.URL.Query().Get("state"))
+	case r.Method == http.MethodPost && r.URL.Path == "/u/login/identifier":
+		h.identifier(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/u/login/password":
+		h.password(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/u/mfa-otp-challenge":
+		h.challenge(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/authorize/resume":
+		h.resume(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/oauth/token":
+		h.token(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/auth/session":
+		h.session(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/backend-api/models":
+		h.models(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("redirect_uri") != redirectURI {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	h.lock.Lock()
+	state := random()
+	h.states[state] = ""
+	h.lock.Unlock()
+	http.Redirect(w, r, "/u/login/identifier?state="+state, http.StatusFound)
+}
+
+func (h *Handler) identifier(w http.ResponseWriter, r *http.Request) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	state := r.FormValue("state")
+	if _, ok := h.states[state]; !ok {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	h.states[state] = r.FormValue("username")
+	http.Redirect(w, r, "/u/login/password?state="+state, http.StatusFound)
+}
+
+func (h *Handler) password(w http.ResponseWriter, r *http.Request) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	state := r.FormValue("state")
+	email, ok := h.states[state]
+	account := h.accounts[email]
+	if !ok || account == nil || email != r.FormValue("username") || account.Password != r.FormValue("password") {
+		http.Error(w, "Wrong email or password", http.StatusBadRequest)
+		return
+	}
+	if account.Banned {
+		http.Error(w, "Your account has been deactivated", http.StatusForbidden)
+		return
+	}
+	h.resumeLocation(w, r, state)
+}
+
+func (h *Handler) challenge(w http.ResponseWriter, r *http.Request) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	state := r.FormValue("state")
+	account := h.accounts[h.states[state]]
+	if account == nil || !validCode(account.MFASecret, r.FormValue("code")) {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	h.verified[state] = true
+	h.resumeLocation(w, r, state)
+}
+
+// resumeLocation redirects to the end of the login of state.
+func (h *Handler) resumeLocation(w http.ResponseWriter, r *http.Request, state string) {
+	http.Redirect(w, r, "/authorize/resume?state="+state, http.StatusFound)
+}
+
+func (h *Handler) resume(w http.ResponseWriter, r *http.Request) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	state := r.URL.Query().Get("state")
+	email, ok := h.states[state]
+	if !ok || email == "" {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	// auth0 asks for the one-time code when the login resumes.
+	if h.accounts[email] != nil && h.accounts[email].MFASecret != "" && !h.verified[state] {
+		http.Redirect(w, r, "/u/mfa-otp-challenge?state="+state, http.StatusFound)
+		return
+	}
+	delete(h.states, state)
+	delete(h.verified, state)
+
+	code := random()
+	h.codes[code] = email
+	w.Header().Set("Location", redirectURI+"?code="+code+"&state="+url.QueryEscape(state))
+	w.WriteHeader(http.StatusFound)
+}
+
+func (h *Handler) token(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	email, ok := h.codes[in.Code]
+	if !ok {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusForbidden)
+		return
+	}
+	delete(h.codes, in.Code)
+
+	token := h.issue(email)
+	h.tokens[token] = email
+	h.logins[email]++
+	writeJSON(w, map[string]interface{}{
+		"access_token":  token,
+		"refresh_token": random(),
+		"expires_in":    int(h.TTL.Seconds()),
+		"token_type":    "Bearer",
+	})
+}
+
+func (h *Handler) session(w http.ResponseWriter, r *http.Request) {
+	email, ok := h.authorized(r)
+	if !ok {
+		writeJSON(w, map[string]interface{}{})
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"user":        map[string]string{"email": email},
+		"accessToken": r.Header.Get("Authorization")[len("Bearer "):],
+	})
+}
+
+func (h *Handler) models(w http.ResponseWriter, r *http.Request) {
+	email, ok := h.authorized(r)
+	if !ok {
+		http.Error(w, `{"detail": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "_puid", Value: "user-" + hex.EncodeToString([]byte(email))})
+	writeJSON(w, map[string]interface{}{"models": []interface{}{}})
+}
+
+// authorized returns the email of the bearer token of r.
+func (h *Handler) authorized(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len("Bearer ") {
+		return "", false
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	email, ok := h.tokens[auth[len("Bearer "):]]
+	return email, ok
+}
+
+// issue returns an unsigned jwt of email.
+func (h *Handler) issue(email string) string {
+	claims, _ := json.Marshal(map[string]interface{}{
+		"email": email,
+		"exp":   time.Now().Add(h.TTL).Unix(),
+		"jti":   random(),
+	})
+	return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(claims) + ".mock"
+}
+
+// validCode reports whether code is the current or the previous TOTP code of secret.
+func validCode(secret, code string) bool {
+	now := time.Now()
+	for _, t := range []time.Time{now, now.Add(-30 * time.Second)} {
+		if want, err := core.TOTP(secret, t); err == nil && want == code {
+			return true
+		}
+	}
+	return false
+}
+
+func random() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Server is a Handler listening on a local address.
+type Server struct {
+	*Handler
+	*httptest.Server
+}
+
+// NewServer starts a Server logging accounts in, the auth and chat
+// endpoints both are its URL.
+func NewServer(accounts ...Account) *Server {
+	h := NewHandler(accounts...)
+	return &Server{Handler: h, Server: httptest.NewServer(h)}
+}
+
+// Options returns the authenticator options logging in against the server.
+func (s *Server) Options() []core.AuthenticatorOption {
+	return []core.AuthenticatorOption{core.WithEndpoints(s.URL, s.URL)}
+}
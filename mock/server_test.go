@@ -0,0 +1,94 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mock
+
+import (
+	"context"
+	"testing"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/core"
+	errors2 "github.com/chatgpt-accesstoken/errors"
+	"github.com/chatgpt-accesstoken/render"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer(
+		Account{Email: "a@b.c", Password: "secret"},
+		Account{Email: "mfa@b.c", Password: "secret", MFASecret: "JBSWY3DPEHPK3PXP"},
+		Account{Email: "banned@b.c", Password: "secret", Banned: true},
+	)
+	defer s.Close()
+
+	factory, err := core.NewOpenaiAuthenticatorFactory(s.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := core.New(core.WithAuthenticator(factory))
+	ctx := context.Background()
+
+	res, err := svc.AccessToken(ctx, &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.AccessToken == "" || res.RefreshToken == "" {
+		t.Errorf("Want access and refresh tokens, got %+v", res)
+	}
+
+	puid, err := svc.PUID(ctx, &akt.OpenaiAuthRequest{AccessToken: res.AccessToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if puid.PUID == "" {
+		t.Errorf("Want the puid of the access token")
+	}
+
+	tests := []struct {
+		name string
+		req  *akt.OpenaiAuthRequest
+		want string
+	}{
+		{name: "mfa", req: &akt.OpenaiAuthRequest{Email: "mfa@b.c", Password: "secret", MFA: "JBSWY3DPEHPK3PXP"}},
+		{name: "mfa required", req: &akt.OpenaiAuthRequest{Email: "mfa@b.c", Password: "secret"}, want: errors2.CodeMFARequired},
+		{name: "mfa rejected", req: &akt.OpenaiAuthRequest{Email: "mfa@b.c", Password: "secret", MFA: "GEZDGNBVGY3TQOJQ"}, want: errors2.CodeMFARejected},
+		{name: "wrong password", req: &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "guess"}, want: errors2.CodeInvalidCredentials},
+		{name: "client profile", req: &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret", ClientProfile: "chrome_110", UserAgent: "akt"}},
+		{name: "invalid proxy", req: &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret", Proxy: "ftp://127.0.0.1:1"}, want: errors2.CodeInvalidRequest},
+		{name: "unknown client profile", req: &akt.OpenaiAuthRequest{Email: "a@b.c", Password: "secret", ClientProfile: "netscape_4"}, want: errors2.CodeInvalidRequest},
+		{name: "banned", req: &akt.OpenaiAuthRequest{Email: "banned@b.c", Password: "secret"}, want: errors2.CodeAccountBanned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := svc.AccessToken(ctx, tt.req)
+			if got := code(err); got != tt.want {
+				t.Errorf("Want error code %q, got %q: %v", tt.want, got, err)
+			}
+		})
+	}
+
+	if got, want := s.Logins("mfa@b.c"), 1; got != want {
+		t.Errorf("Want %d login of the mfa account, got %d", want, got)
+	}
+}
+
+// code returns the error code of err, empty without error.
+func code(err error) string {
+	if err == nil {
+		return ""
+	}
+	return render.Code(err)
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mux
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/gin-gonic/gin"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+	"github.com/chatgpt-accesstoken/render"
+)
+
+type accountRequest struct {
+	Email          string   `json:"email"`
+	Password       string   `json:"password"`
+	MFASecret      string   `json:"mfa_secret"`
+	Labels         []string `json:"labels"`
+	PreferredProxy string   `json:"preferred_proxy"`
+}
+
+// accountItem is an account as returned by the api, without its secrets.
+type accountItem struct {
+	ID             string    `json:"id"`
+	Email          string    `json:"email"`
+	MFA            bool      `json:"mfa"`
+	Labels         []string  `json:"labels"`
+	PreferredProxy string    `json:"preferred_proxy,omitempty"`
+	Created        time.Time `json:"created"`
+	Updated        time.Time `json:"updated"`
+}
+
+func newAccountItem(account *akt.Account) *accountItem {
+	item := &accountItem{
+		ID:      account.ID,
+		Email:   account.Email,
+		MFA:     account.MFASecret != "",
+		Labels:  account.Labels,
+		Created: account.Created,
+		Updated: account.Updated,
+	}
+	if account.PreferredProxy != "" {
+		item.PreferredProxy = akt.ProxyRedacted(account.PreferredProxy)
+	}
+	return item
+}
+
+func (s Server) handlerGetAccounts(ctx *gin.Context) {
+	list, err := s.accountSvc.List(ctx)
+	if err != nil {
+		render.InternalError(ctx.Writer, err)
+		return
+	}
+
+	res := make([]*accountItem, 0, len(list))
+	for _, account := range list {
+		res = append(res, newAccountItem(account))
+	}
+	render.JSON(ctx.Writer, res, http.StatusOK)
+}
+
+func (s Server) handlerGetAccount(ctx *gin.Context) {
+	account, err := s.accountSvc.Get(ctx, ctx.Param("id"))
+	if err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+	render.JSON(ctx.Writer, newAccountItem(account), http.StatusOK)
+}
+
+func (s Server) handlerPostAccount(ctx *gin.Context) {
+	in := new(accountRequest)
+	if err := ctx.BindJSON(in); err != nil {
+		render.BadRequest(ctx.Writer, err)
+		return
+	}
+
+	if !govalidator.IsEmail(in.Email) {
+		render.BadRequest(ctx.Writer, errors.New("api: cannot find email"))
+		return
+	}
+
+	if govalidator.IsNull(in.Password) {
+		render.BadRequest(ctx.Writer, errors.New("api: cannot find password"))
+		return
+	}
+
+	if err := normalizeProxy(&in.PreferredProxy); err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+
+	account := &akt.Account{
+		Email:          in.Email,
+		Password:       in.Password,
+		MFASecret:      in.MFASecret,
+		Labels:         in.Labels,
+		PreferredProxy: in.PreferredProxy,
+	}
+	if err := s.accountSvc.Create(ctx, account); err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+	render.JSON(ctx.Writer, newAccountItem(account), http.StatusCreated)
+}
+
+// handlerPutAccount replaces the account, its password and mfa secret are
+// kept unless given.
+func (s Server) handlerPutAccount(ctx *gin.Context) {
+	in := new(accountRequest)
+	if err := ctx.BindJSON(in); err != nil {
+		render.BadRequest(ctx.Writer, err)
+		return
+	}
+
+	if !govalidator.IsEmail(in.Email) {
+		render.BadRequest(ctx.Writer, errors.New("api: cannot find email"))
+		return
+	}
+
+	if err := normalizeProxy(&in.PreferredProxy); err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+
+	account, err := s.accountSvc.Get(ctx, ctx.Param("id"))
+	if err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+
+	// the token cached for the old email or password is no longer served.
+	stale := account.Email
+	if in.Email == account.Email && (in.Password == "" || in.Password == account.Password) {
+		stale = ""
+	}
+
+	account.Email = in.Email
+	account.Labels = in.Labels
+	account.PreferredProxy = in.PreferredProxy
+	if in.Password != "" {
+		account.Password = in.Password
+	}
+	if in.MFASecret != "" {
+		account.MFASecret = in.MFASecret
+	}
+	if err := s.accountSvc.Update(ctx, account); err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+	if stale != "" {
+		if err := s.evict(ctx, stale); err != nil {
+			render.InternalError(ctx.Writer, err)
+			return
+		}
+	}
+	render.JSON(ctx.Writer, newAccountItem(account), http.StatusOK)
+}
+
+func (s Server) handlerDeleteAccount(ctx *gin.Context) {
+	account, err := s.accountSvc.Get(ctx, ctx.Param("id"))
+	if err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+
+	if err := s.accountSvc.Delete(ctx, account.ID); err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+	if err := s.evict(ctx, account.Email); err != nil {
+		render.InternalError(ctx.Writer, err)
+		return
+	}
+	ctx.Writer.WriteHeader(http.StatusNoContent)
+}
+
+// evict removes the token cached for email and the password remembered to refresh it.
+func (s Server) evict(ctx context.Context, email string) error {
+	if err := s.akStore.Delete(ctx, email); err != nil {
+		return err
+	}
+	if s.credStore != nil {
+		return s.credStore.Delete(ctx, email)
+	}
+	return nil
+}
+
+// handlerPostAccountToken logs the account in with its stored credentials,
+// the caller only knows the account id.
+func (s Server) handlerPostAccountToken(ctx *gin.Context) {
+	account, err := s.accountSvc.Get(ctx, ctx.Param("id"))
+	if err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+
+	c, trace := akt.WithLoginTrace(ctx.Request.Context())
+	req := account.AuthRequest()
+	// ?force_refresh=true logs in again even though a token is cached.
+	req.ForceRefresh = ctx.Query("force_refresh") == "true"
+	res, err := s.openAuthSvc.AccessToken(c, req)
+	setTrace(ctx.Writer, trace)
+	if err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+
+	render.JSON(ctx.Writer, struct {
+		ID          string `json:"id"`
+		AccessToken string `json:"access_token"`
+	}{
+		ID:          account.ID,
+		AccessToken: res.AccessToken,
+	}, http.StatusOK)
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mux
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+	"github.com/asaskevich/govalidator"
+	"github.com/gin-gonic/gin"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+	"github.com/chatgpt-accesstoken/render"
+)
+
+// batchItem is an account of a batch, given by its credentials or its id.
+type batchItem struct {
+	akt.OpenaiAuthRequest
+	AccountID string `json:"account_id,omitempty"`
+}
+
+// batchResult is the outcome of a batch item, streamed once it is done.
+type batchResult struct {
+	Index       int      `json:"index"`
+	Email       string   `json:"email,omitempty"`
+	AccountID   string   `json:"account_id,omitempty"`
+	Status      string   `json:"status"`
+	AccessToken string   `json:"access_token,omitempty"`
+	Code        string   `json:"code,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Proxy       string   `json:"proxy,omitempty"`
+	ProxyTried  []string `json:"proxy_tried,omitempty"`
+	Stale       bool     `json:"stale,omitempty"`
+	TookMs      int64    `json:"took_ms"`
+}
+
+// Status of a batch result.
+const (
+	batchSucceeded = "succeeded"
+	batchFailed    = "failed"
+)
+
+// handlerPostBatch logs every account of the batch in through the cache,
+// at most batchWorkers at a time, and streams one json result per line as
+// soon as each one is done. Once the client is gone or a result cannot be
+// written, no item is dispatched anymore and the running ones are cancelled.
+func (s Server) handlerPostBatch(ctx *gin.Context) {
+	var items []batchItem
+	if err := ctx.BindJSON(&items); err != nil {
+		render.BadRequest(ctx.Writer, err)
+		return
+	}
+
+	if len(items) == 0 {
+		render.BadRequest(ctx.Writer, errors.New("api: batch is empty"))
+		return
+	}
+	if len(items) > s.batchMaxItems {
+		render.BadRequestf(ctx.Writer, "api: batch has %d items, at most %d allowed", len(items), s.batchMaxItems)
+		return
+	}
+
+	c, cancel := context.WithCancel(ctx.Request.Context())
+	defer cancel()
+	jobs := make(chan int)
+	results := make(chan *batchResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.batchWorkers && i < len(items); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results <- s.batch(c, i, &items[i])
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i := range items {
+			select {
+			case <-c.Done():
+				return
+			case jobs <- i:
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	ctx.Writer.Header().Set("Content-Type", "application/x-ndjson")
+	ctx.Writer.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(ctx.Writer)
+	for res := range results {
+		// drain the results of the items running once the stream is broken.
+		if c.Err() != nil {
+			continue
+		}
+		if err := enc.Encode(res); err != nil {
+			cancel()
+			continue
+		}
+		ctx.Writer.Flush()
+	}
+}
+
+// batch logs the item at index i in.
+func (s Server) batch(ctx context.Context, i int, item *batchItem) *batchResult {
+	res := &batchResult{Index: i, Email: item.Email, AccountID: item.AccountID}
+	start := time.Now()
+
+	c, trace := akt.WithLoginTrace(ctx)
+	ak, err := s.batchLogin(c, item)
+	res.TookMs = time.Since(start).Milliseconds()
+	res.ProxyTried = trace.Proxies()
+	res.Stale = trace.Stale()
+	if n := len(res.ProxyTried); n > 0 {
+		res.Proxy = res.ProxyTried[n-1]
+	}
+
+	if err != nil {
+		res.Status = batchFailed
+		res.Code = render.Code(err)
+		res.Error = err.Error()
+		return res
+	}
+	res.Status = batchSucceeded
+	res.AccessToken = ak.AccessToken
+	return res
+}
+
+func (s Server) batchLogin(ctx context.Context, item *batchItem) (*auth.AuthResult, error) {
+	req := &item.OpenaiAuthRequest
+	if item.AccountID != "" {
+		account, err := s.accountSvc.Get(ctx, item.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		req = account.AuthRequest()
+	}
+
+	if govalidator.IsNull(req.Email) || govalidator.IsNull(req.Password) {
+		return nil, errors.NewCode(errors.CodeInvalidRequest, "api: cannot find email or password")
+	}
+	normalized := *req
+	if err := normalizeProxy(&normalized.Proxy); err != nil {
+		return nil, err
+	}
+	req = &normalized
+	return s.openAuthSvc.AccessToken(ctx, req)
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/acheong08/OpenAIAuth/auth"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/core"
+	"github.com/chatgpt-accesstoken/errors"
+)
+
+// stubAuthService logs every email in after its delay, 10ms by default,
+// and records how many logins ran at once.
+type stubAuthService struct {
+	lock    sync.Mutex
+	calls   int
+	running int
+	max     int
+	delays  map[string]time.Duration
+	errs    map[string]error
+	proxies map[string]string
+}
+
+func (s *stubAuthService) login(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	s.lock.Lock()
+	s.calls++
+	s.running++
+	if s.running > s.max {
+		s.max = s.running
+	}
+	delay, ok := s.delays[req.Email]
+	if !ok {
+		delay = 10 * time.Millisecond
+	}
+	err := s.errs[req.Email]
+	if s.proxies == nil {
+		s.proxies = make(map[string]string)
+	}
+	s.proxies[req.Email] = req.Proxy
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.running--
+		s.lock.Unlock()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(delay):
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &auth.AuthResult{AccessToken: "token-" + req.Email}, nil
+}
+
+func (s *stubAuthService) All(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	return s.login(ctx, req)
+}
+
+func (s *stubAuthService) AccessToken(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	return s.login(ctx, req)
+}
+
+func (s *stubAuthService) PUID(ctx context.Context, req *akt.OpenaiAuthRequest) (*auth.AuthResult, error) {
+	return s.login(ctx, req)
+}
+
+func newTestBatchServer(svc akt.OpenaiAuthService, accountSvc akt.AccountService, workers, maxItems int) http.Handler {
+	return New(svc, nil, nil, nil, nil, accountSvc, nil, WithBatch(workers, maxItems)).Handler()
+}
+
+// postBatch posts items to the batch endpoint and returns the results by index.
+func postBatch(t *testing.T, h http.Handler, items []*batchItem) (*httptest.ResponseRecorder, map[int]*batchResult) {
+	t.Helper()
+	body, _ := json.Marshal(items)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth/batch", bytes.NewReader(body)))
+
+	results := make(map[int]*batchResult)
+	if w.Code != http.StatusOK {
+		return w, results
+	}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		res := new(batchResult)
+		if err := json.Unmarshal(scanner.Bytes(), res); err != nil {
+			t.Fatalf("Want one json result per line, got %q: %s", scanner.Text(), err)
+		}
+		results[res.Index] = res
+	}
+	return w, results
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	upstream := &stubAuthService{
+		delays: map[string]time.Duration{"slow@b.c": 100 * time.Millisecond},
+		errs:   map[string]error{"mfa@b.c": errors.ErrMFARejected},
+	}
+	accountSvc := core.NewAccountLocalService()
+	account := &akt.Account{Email: "account@b.c", Password: "secret", PreferredProxy: "HTTP://u:p@Proxy.Example:8080/"}
+	if err := accountSvc.Create(ctx, account); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestBatchServer(upstream, accountSvc, 4, 10)
+
+	item := func(email, password, proxy string) *batchItem {
+		return &batchItem{OpenaiAuthRequest: akt.OpenaiAuthRequest{Email: email, Password: password, Proxy: proxy}}
+	}
+	w, results := postBatch(t, h, []*batchItem{
+		item("slow@b.c", "secret", ""),
+		item("fast@b.c", "secret", ""),
+		item("nopassword@b.c", "", ""),
+		item("proxy@b.c", "secret", "ftp://127.0.0.1:21"),
+		item("mfa@b.c", "secret", ""),
+		{AccountID: account.ID},
+		{AccountID: "unknown"},
+	})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Want ndjson stream, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if len(results) != 7 {
+		t.Fatalf("Want 7 results, got %d", len(results))
+	}
+
+	// the results are streamed as soon as done, the slow login comes last.
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	var last batchResult
+	json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+	if last.Index != 0 {
+		t.Errorf("Want the slow login streamed last, got index %d", last.Index)
+	}
+
+	tests := []struct {
+		index  int
+		status string
+		code   string
+	}{
+		{index: 0, status: batchSucceeded},
+		{index: 1, status: batchSucceeded},
+		{index: 2, status: batchFailed, code: errors.CodeInvalidRequest},
+		{index: 3, status: batchFailed, code: errors.CodeInvalidRequest},
+		{index: 4, status: batchFailed, code: errors.CodeMFARejected},
+		{index: 5, status: batchSucceeded},
+		{index: 6, status: batchFailed, code: errors.CodeNotFound},
+	}
+	for _, tt := range tests {
+		res := results[tt.index]
+		if res == nil || res.Status != tt.status || res.Code != tt.code {
+			t.Errorf("Want item %d %s %q, got %+v", tt.index, tt.status, tt.code, res)
+		}
+	}
+	if got := results[5].AccessToken; got != "token-account@b.c" {
+		t.Errorf("Want the account logged in, got %q", got)
+	}
+	if got, want := upstream.proxies["account@b.c"], "http://u:p@proxy.example:8080"; got != want {
+		t.Errorf("Want the preferred proxy normalized to %s, got %s", want, got)
+	}
+	if _, ok := upstream.proxies["proxy@b.c"]; ok {
+		t.Errorf("Want the invalid proxy rejected before the login")
+	}
+}
+
+func TestBatchWorkers(t *testing.T) {
+	upstream := new(stubAuthService)
+	h := newTestBatchServer(upstream, core.NewAccountLocalService(), 2, 10)
+
+	items := make([]*batchItem, 6)
+	for i := range items {
+		items[i] = &batchItem{OpenaiAuthRequest: akt.OpenaiAuthRequest{Email: string(rune('a'+i)) + "@b.c", Password: "secret"}}
+	}
+	if _, results := postBatch(t, h, items); len(results) != len(items) {
+		t.Fatalf("Want %d results, got %d", len(items), len(results))
+	}
+	if upstream.max != 2 {
+		t.Errorf("Want 2 logins at a time, got %d", upstream.max)
+	}
+
+	if w, _ := postBatch(t, h, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Want empty batch rejected, got %d", w.Code)
+	}
+	if w, _ := postBatch(t, h, make([]*batchItem, 11)); w.Code != http.StatusBadRequest {
+		t.Errorf("Want batch over the limit rejected, got %d", w.Code)
+	}
+	// a null item is an item without credentials.
+	if _, results := postBatch(t, h, make([]*batchItem, 1)); results[0] == nil || results[0].Code != errors.CodeInvalidRequest {
+		t.Errorf("Want null item failed, got %+v", results[0])
+	}
+}
+
+func TestBatchBrokenStream(t *testing.T) {
+	upstream := &stubAuthService{}
+	srv := httptest.NewServer(newTestBatchServer(upstream, core.NewAccountLocalService(), 1, 100))
+	defer srv.Close()
+
+	items := make([]*batchItem, 20)
+	upstream.delays = make(map[string]time.Duration)
+	for i := range items {
+		items[i] = &batchItem{OpenaiAuthRequest: akt.OpenaiAuthRequest{Email: string(rune('a'+i)) + "@b.c", Password: "secret"}}
+		upstream.delays[items[i].Email] = 50 * time.Millisecond
+	}
+	body, _ := json.Marshal(items)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/auth/batch", bytes.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bufio.NewScanner(resp.Body).Scan() {
+		t.Fatal("Want a first result")
+	}
+
+	// the client goes away after the first result.
+	cancel()
+	resp.Body.Close()
+	time.Sleep(300 * time.Millisecond)
+
+	upstream.lock.Lock()
+	calls := upstream.calls
+	upstream.lock.Unlock()
+	if calls > 4 {
+		t.Errorf("Want the batch stopped once the client is gone, got %d logins", calls)
+	}
+}
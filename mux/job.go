@@ -0,0 +1,107 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mux
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/gin-gonic/gin"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+	"github.com/chatgpt-accesstoken/render"
+)
+
+// jobItem is a job as returned by the api, without the login credentials.
+type jobItem struct {
+	ID          string    `json:"id"`
+	Status      string    `json:"status"`
+	Email       string    `json:"email,omitempty"`
+	AccountID   string    `json:"account_id,omitempty"`
+	AccessToken string    `json:"access_token,omitempty"`
+	Code        string    `json:"code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	ProxyTried  []string  `json:"proxy_tried,omitempty"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+}
+
+func newJobItem(job *akt.Job) *jobItem {
+	item := &jobItem{
+		ID:         job.ID,
+		Status:     job.Status,
+		Email:      job.Email,
+		AccountID:  job.AccountID,
+		Code:       job.Code,
+		Error:      job.Error,
+		ProxyTried: job.ProxyTried,
+		Created:    job.Created,
+		Updated:    job.Updated,
+	}
+	if job.Result != nil {
+		item.AccessToken = job.Result.AccessToken
+	}
+	return item
+}
+
+// handlerPostLoginJob queues the login of an account, given by its
+// credentials or its id, and returns the job to poll.
+func (s Server) handlerPostLoginJob(ctx *gin.Context) {
+	in := new(batchItem)
+	if err := ctx.BindJSON(in); err != nil {
+		render.BadRequest(ctx.Writer, err)
+		return
+	}
+
+	job := &akt.Job{AccountID: in.AccountID}
+	if in.AccountID == "" {
+		if govalidator.IsNull(in.Email) || govalidator.IsNull(in.Password) {
+			render.BadRequest(ctx.Writer, errors.New("api: cannot find email or password"))
+			return
+		}
+		if err := normalizeProxy(&in.Proxy); err != nil {
+			render.Error(ctx.Writer, err)
+			return
+		}
+		job.Request = &in.OpenaiAuthRequest
+	}
+
+	if err := s.jobSvc.Create(ctx, job); err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+	render.JSON(ctx.Writer, newJobItem(job), http.StatusAccepted)
+}
+
+func (s Server) handlerGetJob(ctx *gin.Context) {
+	job, err := s.jobSvc.Get(ctx, ctx.Param("id"))
+	if err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+	render.JSON(ctx.Writer, newJobItem(job), http.StatusOK)
+}
+
+func (s Server) handlerDeleteJob(ctx *gin.Context) {
+	if err := s.jobSvc.Cancel(ctx, ctx.Param("id")); err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+	ctx.Writer.WriteHeader(http.StatusNoContent)
+}
@@ -18,11 +18,13 @@ package mux
 
 import (
 	"encoding/json"
-	"errors"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/asaskevich/govalidator"
 
+	"github.com/chatgpt-accesstoken/errors"
 	"github.com/chatgpt-accesstoken/render"
 
 	akt "github.com/chatgpt-accesstoken"
@@ -31,14 +33,54 @@ import (
 
 type Server struct {
 	openAuthSvc akt.OpenaiAuthService
+	akStore     akt.AccessTokenStore
 	proxySvc    akt.ProxyService
+	bindingSvc  akt.ProxyBindingService
+	statsSvc    akt.ProxyStatsService
+	accountSvc  akt.AccountService
+	jobSvc      akt.JobService
+	credStore   akt.CredentialStore
+
+	batchWorkers  int
+	batchMaxItems int
 }
 
-func New(openAuthSvc akt.OpenaiAuthService, proxySvc akt.ProxyService) *Server {
-	return &Server{
-		openAuthSvc: openAuthSvc,
-		proxySvc:    proxySvc,
+// Option configures the server.
+type Option func(*Server)
+
+// WithBatch logs at most workers accounts of a batch in at a time, and
+// rejects the batches of more than maxItems accounts.
+func WithBatch(workers, maxItems int) Option {
+	return func(s *Server) {
+		s.batchWorkers = workers
+		s.batchMaxItems = maxItems
+	}
+}
+
+// WithCredentials forgets the password of an account in credStore once it
+// changes or the account is deleted.
+func WithCredentials(credStore akt.CredentialStore) Option {
+	return func(s *Server) {
+		s.credStore = credStore
+	}
+}
+
+func New(openAuthSvc akt.OpenaiAuthService, akStore akt.AccessTokenStore, proxySvc akt.ProxyService, bindingSvc akt.ProxyBindingService, statsSvc akt.ProxyStatsService, accountSvc akt.AccountService, jobSvc akt.JobService, opts ...Option) *Server {
+	s := &Server{
+		openAuthSvc:   openAuthSvc,
+		akStore:       akStore,
+		proxySvc:      proxySvc,
+		bindingSvc:    bindingSvc,
+		statsSvc:      statsSvc,
+		accountSvc:    accountSvc,
+		jobSvc:        jobSvc,
+		batchWorkers:  4,
+		batchMaxItems: 1000,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 func (s Server) Handler() *gin.Engine {
@@ -52,6 +94,26 @@ func (s Server) Handler() *gin.Engine {
 		ag.POST("/", s.handlerPostAccessToken) // support [潘多拉]
 		ag.POST("/puid", s.handlerPostPUID)
 		ag.POST("/all", s.handlerPostAll)
+		ag.POST("/batch", s.handlerPostBatch)
+		ag.POST("/accounts/:id/token", s.handlerPostAccountToken)
+		ag.POST("/report-invalid", s.handlerPostReportInvalid)
+		ag.DELETE("/:email", s.handlerDeleteToken)
+	}
+
+	jg := r.Group("/jobs")
+	{
+		jg.POST("/login", s.handlerPostLoginJob)
+		jg.GET("/:id", s.handlerGetJob)
+		jg.DELETE("/:id", s.handlerDeleteJob)
+	}
+
+	acg := r.Group("/accounts")
+	{
+		acg.GET("/", s.handlerGetAccounts)
+		acg.POST("/", s.handlerPostAccount)
+		acg.GET("/:id", s.handlerGetAccount)
+		acg.PUT("/:id", s.handlerPutAccount)
+		acg.DELETE("/:id", s.handlerDeleteAccount)
 	}
 
 	pg := r.Group("/proxy")
@@ -59,6 +121,11 @@ func (s Server) Handler() *gin.Engine {
 		pg.GET("/", s.handlerGetProxy)
 		pg.POST("/", s.handlerPostProxy)
 		pg.DELETE("/:id", s.handlerDeleteProxy)
+		pg.GET("/bindings/:email", s.handlerGetProxyBinding)
+		pg.PUT("/bindings/:email", s.handlerPutProxyBinding)
+		pg.DELETE("/bindings/:email", s.handlerDeleteProxyBinding)
+		pg.GET("/stats", s.handlerGetProxyStats)
+		pg.GET("/stats/:id", s.handlerGetProxyStat)
 	}
 	return r
 }
@@ -84,9 +151,11 @@ func (s Server) handlerPostAccessToken(ctx *gin.Context) {
 		return
 	}
 
-	res, err := s.openAuthSvc.AccessToken(ctx, in)
+	c, trace := akt.WithLoginTrace(ctx.Request.Context())
+	res, err := s.openAuthSvc.AccessToken(c, in)
+	setTrace(ctx.Writer, trace)
 	if err != nil {
-		render.InternalError(ctx.Writer, err)
+		render.Error(ctx.Writer, err)
 		return
 	}
 
@@ -109,9 +178,11 @@ func (s Server) handlerPostPUID(ctx *gin.Context) {
 		return
 	}
 
-	res, err := s.openAuthSvc.PUID(ctx, in)
+	c, trace := akt.WithLoginTrace(ctx.Request.Context())
+	res, err := s.openAuthSvc.PUID(c, in)
+	setTrace(ctx.Writer, trace)
 	if err != nil {
-		render.InternalError(ctx.Writer, err)
+		render.Error(ctx.Writer, err)
 		return
 	}
 	render.JSON(ctx.Writer, res, http.StatusOK)
@@ -134,14 +205,29 @@ func (s Server) handlerPostAll(ctx *gin.Context) {
 		return
 	}
 
-	res, err := s.openAuthSvc.AccessToken(ctx, in)
+	c, trace := akt.WithLoginTrace(ctx.Request.Context())
+	res, err := s.openAuthSvc.AccessToken(c, in)
+	setTrace(ctx.Writer, trace)
 	if err != nil {
-		render.InternalError(ctx.Writer, err)
+		render.Error(ctx.Writer, err)
 		return
 	}
 	render.JSON(ctx.Writer, res, http.StatusOK)
 }
 
+// setTrace reports the proxies the request logged in through, in order,
+// and whether the token served has expired.
+func setTrace(w http.ResponseWriter, trace *akt.LoginTrace) {
+	if ids := trace.Proxies(); len(ids) > 0 {
+		w.Header().Set("X-Proxy-Tried", strings.Join(ids, ","))
+	}
+	if trace.Stale() {
+		w.Header().Set("X-Token-Stale", "true")
+	}
+}
+
+// handlerGetProxy lists the proxies with their credentials masked, as
+// {id, proxy} items, or as the plain list of proxies with ?format=list.
 func (s Server) handlerGetProxy(ctx *gin.Context) {
 	list, err := s.proxySvc.List(ctx)
 	if err != nil {
@@ -149,7 +235,25 @@ func (s Server) handlerGetProxy(ctx *gin.Context) {
 		return
 	}
 
-	render.JSON(ctx.Writer, list, 20)
+	if ctx.Query("format") == "list" {
+		res := make([]string, 0, len(list))
+		for _, proxy := range list {
+			res = append(res, akt.ProxyRedacted(proxy))
+		}
+		render.JSON(ctx.Writer, res, http.StatusOK)
+		return
+	}
+
+	res := make([]*proxyItem, 0, len(list))
+	for _, proxy := range list {
+		res = append(res, &proxyItem{ID: akt.ProxyID(proxy), Proxy: akt.ProxyRedacted(proxy)})
+	}
+	render.JSON(ctx.Writer, res, http.StatusOK)
+}
+
+type proxyItem struct {
+	ID    string `json:"id"`
+	Proxy string `json:"proxy"`
 }
 
 type proxyRequest struct {
@@ -169,7 +273,7 @@ func (s Server) handlerPostProxy(ctx *gin.Context) {
 	}
 
 	if err := s.proxySvc.Add(ctx, in.Proxy); err != nil {
-		render.InternalError(ctx.Writer, err)
+		render.Error(ctx.Writer, err)
 		return
 	}
 
@@ -177,9 +281,27 @@ func (s Server) handlerPostProxy(ctx *gin.Context) {
 }
 
 func (s Server) handlerDeleteProxy(ctx *gin.Context) {
-	ip := ctx.Param("ip")
-	if govalidator.IsNull(ip) {
-		render.BadRequest(ctx.Writer, errors.New("api: cannot find ip"))
+	id := ctx.Param("id")
+	if govalidator.IsNull(id) {
+		render.BadRequest(ctx.Writer, errors.New("api: cannot find id"))
+		return
+	}
+
+	list, err := s.proxySvc.List(ctx)
+	if err != nil {
+		render.InternalError(ctx.Writer, err)
+		return
+	}
+
+	ip := ""
+	for _, proxy := range list {
+		if akt.ProxyID(proxy) == id {
+			ip = proxy
+			break
+		}
+	}
+	if ip == "" {
+		render.NotFoundf(ctx.Writer, "api: cannot find proxy %s", id)
 		return
 	}
 
@@ -190,6 +312,161 @@ func (s Server) handlerDeleteProxy(ctx *gin.Context) {
 	ctx.Writer.WriteHeader(http.StatusNoContent)
 }
 
+type proxyBinding struct {
+	Email   string `json:"email"`
+	ProxyID string `json:"proxy_id"`
+	Proxy   string `json:"proxy"` // Proxy redacted proxy address.
+}
+
+func newProxyBinding(email, proxy string) *proxyBinding {
+	return &proxyBinding{Email: email, ProxyID: akt.ProxyID(proxy), Proxy: akt.ProxyRedacted(proxy)}
+}
+
+func (s Server) handlerGetProxyBinding(ctx *gin.Context) {
+	email := ctx.Param("email")
+	proxy, err := s.bindingSvc.Get(ctx, email)
+	if err == errors.ErrNotFound {
+		render.NotFoundf(ctx.Writer, "api: %s is not bound to a proxy", email)
+		return
+	}
+	if err != nil {
+		render.InternalError(ctx.Writer, err)
+		return
+	}
+
+	render.JSON(ctx.Writer, newProxyBinding(email, proxy), http.StatusOK)
+}
+
+func (s Server) handlerPutProxyBinding(ctx *gin.Context) {
+	in := new(proxyRequest)
+	if err := ctx.BindJSON(in); err != nil {
+		render.BadRequest(ctx.Writer, err)
+		return
+	}
+
+	if govalidator.IsNull(in.Proxy) {
+		render.BadRequest(ctx.Writer, errors.New("api: cannot find proxy"))
+		return
+	}
+
+	proxy, err := akt.ParseProxy(in.Proxy)
+	if err != nil {
+		render.Error(ctx.Writer, err)
+		return
+	}
+
+	list, err := s.proxySvc.List(ctx)
+	if err != nil {
+		render.InternalError(ctx.Writer, err)
+		return
+	}
+	if !contains(list, proxy) {
+		// the entries added before the urls were normalized are only found as they are.
+		if !contains(list, in.Proxy) {
+			render.BadRequestf(ctx.Writer, "api: %s is not in the proxy pool", akt.ProxyRedacted(proxy))
+			return
+		}
+		proxy = in.Proxy
+	}
+
+	email := ctx.Param("email")
+	if err := s.bindingSvc.Bind(ctx, email, proxy); err != nil {
+		render.InternalError(ctx.Writer, err)
+		return
+	}
+
+	render.JSON(ctx.Writer, newProxyBinding(email, proxy), http.StatusOK)
+}
+
+func (s Server) handlerDeleteProxyBinding(ctx *gin.Context) {
+	email := ctx.Param("email")
+	err := s.bindingSvc.Unbind(ctx, email)
+	if err == errors.ErrNotFound {
+		render.NotFoundf(ctx.Writer, "api: %s is not bound to a proxy", email)
+		return
+	}
+	if err != nil {
+		render.InternalError(ctx.Writer, err)
+		return
+	}
+	ctx.Writer.WriteHeader(http.StatusNoContent)
+}
+
+// proxyStatsOrder are the sort keys of the proxy stats, each one orders
+// the stats ascending.
+var proxyStatsOrder = map[string]func(a, b *akt.ProxyStats) bool{
+	"failure_rate": func(a, b *akt.ProxyStats) bool { return a.FailureRate < b.FailureRate },
+	"attempts":     func(a, b *akt.ProxyStats) bool { return a.Attempts < b.Attempts },
+	"avg_latency":  func(a, b *akt.ProxyStats) bool { return a.AvgLatencyMs < b.AvgLatencyMs },
+	"last_used":    func(a, b *akt.ProxyStats) bool { return a.LastUsed.Before(b.LastUsed) },
+}
+
+// handlerGetProxyStats lists the proxy stats sorted by ?sort=, failure_rate
+// by default, in ?order=asc or desc order, desc by default.
+func (s Server) handlerGetProxyStats(ctx *gin.Context) {
+	less, ok := proxyStatsOrder[ctx.DefaultQuery("sort", "failure_rate")]
+	if !ok {
+		render.BadRequestf(ctx.Writer, "api: cannot sort proxy stats by %s", ctx.Query("sort"))
+		return
+	}
+
+	order := ctx.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		render.BadRequestf(ctx.Writer, "api: unknown order %s", order)
+		return
+	}
+
+	list, err := s.statsSvc.List(ctx)
+	if err != nil {
+		render.InternalError(ctx.Writer, err)
+		return
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if order == "asc" {
+			return less(list[i], list[j])
+		}
+		return less(list[j], list[i])
+	})
+	render.JSON(ctx.Writer, list, http.StatusOK)
+}
+
+func (s Server) handlerGetProxyStat(ctx *gin.Context) {
+	id := ctx.Param("id")
+	st, err := s.statsSvc.Get(ctx, id)
+	if err == errors.ErrNotFound {
+		render.NotFoundf(ctx.Writer, "api: cannot find stats of proxy %s", id)
+		return
+	}
+	if err != nil {
+		render.InternalError(ctx.Writer, err)
+		return
+	}
+	render.JSON(ctx.Writer, st, http.StatusOK)
+}
+
+// normalizeProxy normalizes the proxy url given to a request, if any.
+func normalizeProxy(proxy *string) error {
+	if *proxy == "" {
+		return nil
+	}
+	v, err := akt.ParseProxy(*proxy)
+	if err != nil {
+		return err
+	}
+	*proxy = v
+	return nil
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
 // JSON writes the json-encoded error message to the response
 // with a 400 bad request status code.
 func JSON(w http.ResponseWriter, v interface{}, status int) {
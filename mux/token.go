@@ -0,0 +1,106 @@
+/*
+Copyright 2022 The deepauto-io LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mux
+
+import (
+	"net/http"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/gin-gonic/gin"
+
+	akt "github.com/chatgpt-accesstoken"
+	"github.com/chatgpt-accesstoken/errors"
+	"github.com/chatgpt-accesstoken/render"
+)
+
+// handlerDeleteToken evicts the cached token of the email, the next request
+// logs in again.
+func (s Server) handlerDeleteToken(ctx *gin.Context) {
+	email := ctx.Param("email")
+	if govalidator.IsNull(email) {
+		render.BadRequest(ctx.Writer, errors.New("api: cannot find email"))
+		return
+	}
+
+	if err := s.akStore.Delete(ctx, email); err != nil {
+		render.InternalError(ctx.Writer, err)
+		return
+	}
+	ctx.Writer.WriteHeader(http.StatusNoContent)
+}
+
+type reportInvalidRequest struct {
+	akt.OpenaiAuthRequest
+	// Refetch log in again right away, Password is required.
+	Refetch bool `json:"refetch"`
+}
+
+type reportInvalidResult struct {
+	Evicted     bool   `json:"evicted"`
+	AccessToken string `json:"access_token,omitempty"`
+}
+
+// handlerPostReportInvalid evicts the token ChatGPT rejected. The cached
+// token is kept when it is no longer the one reported, it was refreshed
+// since.
+func (s Server) handlerPostReportInvalid(ctx *gin.Context) {
+	in := new(reportInvalidRequest)
+	if err := ctx.BindJSON(in); err != nil {
+		render.BadRequest(ctx.Writer, err)
+		return
+	}
+
+	if govalidator.IsNull(in.Email) {
+		render.BadRequest(ctx.Writer, errors.New("api: cannot find email"))
+		return
+	}
+
+	if govalidator.IsNull(in.AccessToken) {
+		render.BadRequest(ctx.Writer, errors.New("api: cannot find access token"))
+		return
+	}
+
+	if in.Refetch && govalidator.IsNull(in.Password) {
+		render.BadRequest(ctx.Writer, errors.New("api: cannot find password"))
+		return
+	}
+
+	res := new(reportInvalidResult)
+	if cached, err := s.akStore.Get(ctx, in.Email); err == nil && cached.AuthResult != nil && cached.AccessToken == in.AccessToken {
+		if err := s.akStore.Delete(ctx, in.Email); err != nil {
+			render.InternalError(ctx.Writer, err)
+			return
+		}
+		res.Evicted = true
+	}
+
+	if in.Refetch {
+		req := in.OpenaiAuthRequest
+		req.AccessToken = ""
+
+		c, trace := akt.WithLoginTrace(ctx.Request.Context())
+		ak, err := s.openAuthSvc.AccessToken(c, &req)
+		setTrace(ctx.Writer, trace)
+		if err != nil {
+			render.Error(ctx.Writer, err)
+			return
+		}
+		res.AccessToken = ak.AccessToken
+	}
+
+	render.JSON(ctx.Writer, res, http.StatusOK)
+}
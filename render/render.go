@@ -17,15 +17,85 @@ limitations under the License.
 package render
 
 import (
+	"context"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"github.com/chatgpt-accesstoken/errors"
 	"net/http"
 )
 
+// statusCodes maps the error codes to http status codes.
+var statusCodes = map[string]int{
+	errors.CodeInvalidRequest:     http.StatusBadRequest,
+	errors.CodeUnauthorized:       http.StatusUnauthorized,
+	errors.CodeForbidden:          http.StatusForbidden,
+	errors.CodeNotFound:           http.StatusNotFound,
+	errors.CodeNotImplemented:     http.StatusNotImplemented,
+	errors.CodePasswordMismatch:   http.StatusUnauthorized,
+	errors.CodeInvalidCredentials: http.StatusUnauthorized,
+	errors.CodeAccountBanned:      http.StatusForbidden,
+	errors.CodeMFARequired:        http.StatusUnauthorized,
+	errors.CodeMFARejected:        http.StatusUnauthorized,
+	errors.CodeCloudflare:         http.StatusForbidden,
+	errors.CodeRateLimited:        http.StatusTooManyRequests,
+	errors.CodeProxy:              http.StatusBadGateway,
+	errors.CodeUpstream:           http.StatusBadGateway,
+	errors.CodeTimeout:            http.StatusGatewayTimeout,
+	errors.CodeUnavailable:        http.StatusServiceUnavailable,
+}
+
+// Error writes the json-encoded error message to the response
+// with the status code of its error code, 500 for unknown codes.
+func Error(w http.ResponseWriter, err error) {
+	status, ok := statusCodes[errorOf(err).Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	ErrorCode(w, err, status)
+}
+
+// statusDefaultCodes maps the http status codes to the codes of errors without one.
+var statusDefaultCodes = map[int]string{
+	http.StatusBadRequest:     errors.CodeInvalidRequest,
+	http.StatusUnauthorized:   errors.CodeUnauthorized,
+	http.StatusForbidden:      errors.CodeForbidden,
+	http.StatusNotFound:       errors.CodeNotFound,
+	http.StatusNotImplemented: errors.CodeNotImplemented,
+}
+
 // ErrorCode writes the json-encoded error message to the response.
 func ErrorCode(w http.ResponseWriter, err error, status int) {
-	JSON(w, &errors.Error{Message: err.Error()}, status)
+	e := errorOf(err)
+	if e.Code == errors.CodeUnknown {
+		if code, ok := statusDefaultCodes[status]; ok {
+			e.Code = code
+		}
+	}
+	JSON(w, e, status)
+}
+
+// Code returns the error code of err as written to the response.
+func Code(err error) string {
+	return errorOf(err).Code
+}
+
+// errorOf returns the api error err is or wraps, with the message of err.
+func errorOf(err error) *errors.Error {
+	e := &errors.Error{Code: errors.CodeUnknown, Message: err.Error()}
+	if stderrors.Is(err, context.DeadlineExceeded) || stderrors.Is(err, context.Canceled) {
+		e.Code = errors.CodeTimeout
+	}
+
+	var apiErr *errors.Error
+	if stderrors.As(err, &apiErr) {
+		e.Location = apiErr.Location
+		e.UpstreamStatus = apiErr.UpstreamStatus
+		if apiErr.Code != "" {
+			e.Code = apiErr.Code
+		}
+	}
+	return e
 }
 
 // InternalError writes the json-encoded error message to the response
@@ -122,6 +122,15 @@ func (r *Redis) HGetAll(k string) (map[string]string, error) {
 	return r.single.HGetAll(context.Background(), k).Result()
 }
 
+func (r *Redis) HIncrBy(k, f string, v int64) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.clusterMode {
+		return r.cluster.HIncrBy(context.Background(), k, f, v).Err()
+	}
+	return r.single.HIncrBy(context.Background(), k, f, v).Err()
+}
+
 func (r *Redis) HDel(k, f string) error {
 	r.mux.Lock()
 	defer r.mux.Unlock()
@@ -164,6 +173,48 @@ func (r *Redis) Keys(k string) []string {
 	return r.single.Keys(context.Background(), k).Val()
 }
 
+// Scan returns the keys matching the pattern k, iterating with SCAN so that
+// redis is not blocked on a large keyspace.
+func (r *Redis) Scan(k string) ([]string, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if !r.clusterMode {
+		return scan(r.single, k)
+	}
+
+	var (
+		lock sync.Mutex
+		keys []string
+	)
+	err := r.cluster.ForEachMaster(context.Background(), func(ctx context.Context, client *redis.Client) error {
+		res, err := scan(client, k)
+		lock.Lock()
+		keys = append(keys, res...)
+		lock.Unlock()
+		return err
+	})
+	return keys, err
+}
+
+func scan(client *redis.Client, k string) ([]string, error) {
+	var keys []string
+	iter := client.Scan(context.Background(), 0, k, 100).Iterator()
+	for iter.Next(context.Background()) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// HSetNX set the field f of k only if it does not exist, report whether it was set.
+func (r *Redis) HSetNX(k, f string, v interface{}) (bool, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.clusterMode {
+		return r.cluster.HSetNX(context.Background(), k, f, v).Result()
+	}
+	return r.single.HSetNX(context.Background(), k, f, v).Result()
+}
+
 func (r *Redis) Del(k string) error {
 	r.mux.Lock()
 	defer r.mux.Unlock()
@@ -243,31 +294,88 @@ func (r *Redis) LPush(k, f string) error {
 	return r.single.LPush(context.Background(), k, f).Err()
 }
 
+// BRPop pops the last element of k, waiting at most timeout for one. It
+// does not hold the lock while it blocks, it returns nil once timed out.
 func (r *Redis) BRPop(timeout time.Duration, k string) ([]string, error) {
+	var res []string
+	var err error
+	if r.clusterMode {
+		res, err = r.cluster.BRPop(context.Background(), timeout, k).Result()
+	} else {
+		res, err = r.single.BRPop(context.Background(), timeout, k).Result()
+	}
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return res, err
+}
+
+// LockNx set k only if it does not exist, report whether the lock was obtained.
+func (r *Redis) LockNx(k, v string, t time.Duration) (bool, error) {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 	if r.clusterMode {
-		return r.cluster.BRPop(context.Background(), timeout, k).Result()
+		return r.cluster.SetNX(context.Background(), k, v, t).Result()
 	}
-	return r.single.BRPop(context.Background(), timeout, k).Result()
+	return r.single.SetNX(context.Background(), k, v, t).Result()
 }
 
-func (r *Redis) LockNx(k, v string, t time.Duration) error {
+// unlockScript deletes the lock only if it still holds the value set by its owner.
+var unlockScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`)
+
+// UnLockNx delete k only if its value is still v, so that a lock which
+// expired and was obtained by someone else is left alone.
+func (r *Redis) UnLockNx(k, v string) error {
 	r.mux.Lock()
 	defer r.mux.Unlock()
 	if r.clusterMode {
-		return r.cluster.SetNX(context.Background(), k, v, t).Err()
+		return unlockScript.Run(context.Background(), r.cluster, []string{k}, v).Err()
 	}
-	return r.single.SetNX(context.Background(), k, v, t).Err()
+	return unlockScript.Run(context.Background(), r.single, []string{k}, v).Err()
 }
 
-func (r *Redis) UnLockNx(k string) error {
+// setIfFieldScript replaces the json object of a key only if one of its fields holds a value.
+var setIfFieldScript = redis.NewScript(`
+local v = redis.call("get", KEYS[1])
+if not v or cjson.decode(v)[ARGV[1]] ~= ARGV[2] then return 0 end
+if tonumber(ARGV[4]) > 0 then redis.call("set", KEYS[1], ARGV[3], "PX", ARGV[4]) else redis.call("set", KEYS[1], ARGV[3]) end
+return 1`)
+
+// SetIfField set k to v for t only if the json object k holds has field
+// equal to want, report whether it was set.
+func (r *Redis) SetIfField(k, field, want, v string, t time.Duration) (bool, error) {
 	r.mux.Lock()
 	defer r.mux.Unlock()
+	var (
+		n   int64
+		err error
+	)
 	if r.clusterMode {
-		return r.cluster.Del(context.Background(), k).Err()
+		n, err = setIfFieldScript.Run(context.Background(), r.cluster, []string{k}, field, want, v, t.Milliseconds()).Int64()
+	} else {
+		n, err = setIfFieldScript.Run(context.Background(), r.single, []string{k}, field, want, v, t.Milliseconds()).Int64()
 	}
-	return r.single.Del(context.Background(), k).Err()
+	return n == 1, err
+}
+
+// extendScript expires the lock again only if it still holds the value set by its owner.
+var extendScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) end return 0`)
+
+// ExtendNx expire k after t again only if its value is still v, report
+// whether the lock is still held.
+func (r *Redis) ExtendNx(k, v string, t time.Duration) (bool, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var (
+		n   int64
+		err error
+	)
+	if r.clusterMode {
+		n, err = extendScript.Run(context.Background(), r.cluster, []string{k}, v, t.Milliseconds()).Int64()
+	} else {
+		n, err = extendScript.Run(context.Background(), r.single, []string{k}, v, t.Milliseconds()).Int64()
+	}
+	return n == 1, err
 }
 
 func (r *Redis) Close() error {
@@ -0,0 +1,143 @@
+/*
+Copyright 2022 The Workpieces LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chatgpt_accesstoken
+
+import (
+	"context"
+	"sync"
+)
+
+type traceKey struct{}
+
+// LoginAttempt is an upstream login made to serve a request.
+type LoginAttempt struct {
+	ProxyID string `json:"proxy_id"`        // ProxyID proxy the login went through, see ProxyID.
+	Error   string `json:"error,omitempty"` // Error failure of the login.
+}
+
+// LoginTrace records how a request was served.
+type LoginTrace struct {
+	lock      sync.Mutex
+	attempts  []LoginAttempt
+	stale     bool
+	refreshed bool
+}
+
+// WithLoginTrace returns a context recording how the request is served into the returned trace.
+func WithLoginTrace(ctx context.Context) (context.Context, *LoginTrace) {
+	trace := new(LoginTrace)
+	return context.WithValue(ctx, traceKey{}, trace), trace
+}
+
+// LoginTraceFrom returns the trace of ctx, nil if ctx is not traced.
+func LoginTraceFrom(ctx context.Context) *LoginTrace {
+	trace, _ := ctx.Value(traceKey{}).(*LoginTrace)
+	return trace
+}
+
+// Attempt records a login made through proxy, err is nil on success.
+func (t *LoginTrace) Attempt(proxy string, err error) {
+	if t == nil {
+		return
+	}
+
+	a := LoginAttempt{ProxyID: ProxyID(proxy)}
+	if err != nil {
+		a.Error = err.Error()
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.attempts = append(t.attempts, a)
+}
+
+// Attempts returns the logins made in order.
+func (t *LoginTrace) Attempts() []LoginAttempt {
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]LoginAttempt(nil), t.attempts...)
+}
+
+// Proxies returns the proxies tried in order.
+func (t *LoginTrace) Proxies() []string {
+	var ids []string
+	for _, a := range t.Attempts() {
+		ids = append(ids, a.ProxyID)
+	}
+	return ids
+}
+
+// MarkStale records that an expired token was served while it is refreshed.
+func (t *LoginTrace) MarkStale() {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.stale = true
+}
+
+// Stale reports whether an expired token was served.
+func (t *LoginTrace) Stale() bool {
+	if t == nil {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.stale
+}
+
+// MarkRefreshed records that the login replaces a token cached for the email.
+func (t *LoginTrace) MarkRefreshed() {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.refreshed = true
+}
+
+// Refreshed reports whether the login replaces a cached token.
+func (t *LoginTrace) Refreshed() bool {
+	if t == nil {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.refreshed
+}
+
+// Merge records the logins of other into t.
+func (t *LoginTrace) Merge(other *LoginTrace) {
+	if t == nil || other == nil || t == other {
+		return
+	}
+
+	attempts, refreshed := other.Attempts(), other.Refreshed()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.attempts = append(t.attempts, attempts...)
+	t.refreshed = t.refreshed || refreshed
+}